@@ -0,0 +1,834 @@
+// Package catalog loads config.json and the data it references into an
+// immutable Catalog and reloads it when the configuration changes.
+package catalog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reymond-group/underdarkgo/metrics"
+	"github.com/reymond-group/underdarkgo/storage"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// The configuration and the data loaded for it, looked up by the dotted ids.
+// A catalog is not modified once created, so it is safe for concurrent use.
+// Reloading config.json creates a new catalog.
+type Catalog struct {
+	config Configuration
+
+	variantIndices map[string][][]uint32
+	indicesSizes   map[string]int64
+	infoOffsets    map[string][]uint64
+	infoLengths    map[string][]uint32
+
+	// Inverted index (id or smiles -> line numbers) per fingerprint and the
+	// reverse lookup (line number -> bin index) per variant
+	searchIndices map[string]*storage.SearchIndexFile
+	compoundBins  map[string][]uint32
+
+	// The coordinates of each bin, one line of the coordinates file per bin
+	variantCoordinates map[string][]string
+
+	// The (non-empty) bin at each grid cell of a variant
+	variantGrids map[string]map[GridCell]uint32
+
+	// Allow fast access by id
+	databases    map[string]Database
+	fingerprints map[string]Fingerprint
+	variants     map[string]Variant
+	colorMaps    map[string]ColorMap
+	stats        map[string]Stats
+
+	// The id of the database of each fingerprint, of the fingerprint of
+	// each variant and of the variant of each map
+	parents map[string]string
+
+	// The modification times of the loaded files, unchanged files are not
+	// loaded again on reload
+	modTimes map[string]time.Time
+
+	// The ids of the databases, fingerprints, variants and maps that can be
+	// looked up, all if nil, see Restrict
+	visible map[string]bool
+}
+
+type GridCell [3]int
+
+var dataLoads = metrics.NewCounter("underdark_data_loads_total",
+	"The number of times loading the configuration reused fingerprint and variant data from the previous catalog (reused) or read it from disk (loaded) and opened (loaded) or built (built) search indices.",
+	"data", "result")
+
+// Creates a catalog from the configuration and loads the data of all
+// databases, fingerprints and variants it references, the paths in the
+// configuration are relative to the data directory. The data of the
+// previous catalog (if any) is reused for files that are unchanged. Also
+// returns the ids of the variants that are new or whose files have changed.
+func New(dataDir string, config Configuration, previous *Catalog) (*Catalog, []string, error) {
+	catalog := empty(config)
+
+	if err := checkConfig(catalog, dataDir); err != nil {
+		return nil, nil, err
+	}
+
+	changed, err := loadIndices(catalog, previous)
+
+	if err != nil {
+		catalog.closeSearchIndices(previous)
+		return nil, nil, err
+	}
+
+	return catalog, changed, nil
+}
+
+// Closes the search indices that were opened for the catalog, those reused
+// from the previous catalog are still in use
+func (catalog *Catalog) closeSearchIndices(previous *Catalog) {
+	for id, index := range catalog.searchIndices {
+		if index != previous.searchIndex(id) {
+			index.Close()
+		}
+	}
+}
+
+// Checks that the configuration in the data directory is valid and that all
+// files it references exist, without loading any data. Returns the
+// configuration with the ids and paths prefixed.
+func Check(dataDir string) (Configuration, error) {
+	config, err := LoadConfig(dataDir)
+
+	if err != nil {
+		return Configuration{}, err
+	}
+
+	catalog := empty(config)
+
+	if err := checkConfig(catalog, dataDir); err != nil {
+		return Configuration{}, err
+	}
+
+	return catalog.config, nil
+}
+
+func empty(config Configuration) *Catalog {
+	return &Catalog{
+		config:             config,
+		variantIndices:     map[string][][]uint32{},
+		indicesSizes:       map[string]int64{},
+		infoOffsets:        map[string][]uint64{},
+		infoLengths:        map[string][]uint32{},
+		searchIndices:      map[string]*storage.SearchIndexFile{},
+		compoundBins:       map[string][]uint32{},
+		variantCoordinates: map[string][]string{},
+		variantGrids:       map[string]map[GridCell]uint32{},
+		databases:          map[string]Database{},
+		fingerprints:       map[string]Fingerprint{},
+		variants:           map[string]Variant{},
+		colorMaps:          map[string]ColorMap{},
+		stats:              map[string]Stats{},
+		parents:            map[string]string{},
+		modTimes:           map[string]time.Time{},
+	}
+}
+
+// The configuration the catalog was created from, with ids and paths
+// prefixed
+func (catalog *Catalog) Config() Configuration {
+	return catalog.config
+}
+
+// Returns a view of the catalog that only contains the databases the names
+// (e.g. the name and roles of a token) may access, see Database.Allows.
+// Lookups of anything in the other databases fail as if it did not exist.
+func (catalog *Catalog) Restrict(names []string) *Catalog {
+	view := *catalog
+	view.config = Configuration{Databases: []Database{}}
+	view.visible = map[string]bool{}
+
+	for _, database := range catalog.config.Databases {
+		if database.Allows(names) && !catalog.hides(database.Id) {
+			// Who may access a database is not revealed to the clients
+			database.Access = nil
+			view.config.Databases = append(view.config.Databases, database)
+		}
+	}
+
+	loopConfig(&view.config, "", func(database *Database, path string) {
+		view.visible[database.Id] = true
+	}, func(fingerprint *Fingerprint, path string) {
+		view.visible[fingerprint.Id] = true
+	}, func(variant *Variant, path string) {
+		view.visible[variant.Id] = true
+	}, func(colorMap *ColorMap, path string) {
+		view.visible[colorMap.Id] = true
+	}, false, false)
+
+	return &view
+}
+
+// Returns whether the id is outside the databases of a restricted catalog
+func (catalog *Catalog) hides(id string) bool {
+	return catalog.visible != nil && !catalog.visible[id]
+}
+
+func (catalog *Catalog) Database(id string) (Database, error) {
+	database, ok := catalog.databases[id]
+
+	if !ok || catalog.hides(id) {
+		return Database{}, underdark.NewError(underdark.ErrUnknownDatabase, "unknown database %s", id)
+	}
+
+	return database, nil
+}
+
+func (catalog *Catalog) Fingerprint(id string) (Fingerprint, error) {
+	fingerprint, ok := catalog.fingerprints[id]
+
+	if !ok || catalog.hides(id) {
+		return Fingerprint{}, underdark.NewError(underdark.ErrUnknownFingerprint, "unknown fingerprint %s", id)
+	}
+
+	return fingerprint, nil
+}
+
+func (catalog *Catalog) Variant(id string) (Variant, error) {
+	variant, ok := catalog.variants[id]
+
+	if !ok || catalog.hides(id) {
+		return Variant{}, underdark.NewError(underdark.ErrUnknownVariant, "unknown variant %s", id)
+	}
+
+	return variant, nil
+}
+
+func (catalog *Catalog) ColorMap(id string) (ColorMap, error) {
+	colorMap, ok := catalog.colorMaps[id]
+
+	if !ok || catalog.hides(id) {
+		return ColorMap{}, underdark.NewError(underdark.ErrUnknownMap, "unknown map %s", id)
+	}
+
+	return colorMap, nil
+}
+
+// Returns whether the fingerprint, variant or map with the id belongs to
+// the database, fingerprint or variant with the parent id
+func (catalog *Catalog) Contains(parentId string, id string) bool {
+	return catalog.parents[id] == parentId && !catalog.hides(id)
+}
+
+func (catalog *Catalog) Stats(variantId string) (Stats, error) {
+	variantStats, ok := catalog.stats[variantId]
+
+	if !ok || catalog.hides(variantId) {
+		return Stats{}, underdark.NewError(underdark.ErrUnknownVariant, "unknown variant %s", variantId)
+	}
+
+	return variantStats, nil
+}
+
+// Returns the offsets and lengths of the lines of the infos file
+func (catalog *Catalog) InfoIndex(fingerprintId string) ([]uint64, []uint32, error) {
+	offsets, ok := catalog.infoOffsets[fingerprintId]
+
+	if !ok || catalog.hides(fingerprintId) {
+		return nil, nil, underdark.NewError(underdark.ErrUnknownFingerprint, "unknown fingerprint %s", fingerprintId)
+	}
+
+	return offsets, catalog.infoLengths[fingerprintId], nil
+}
+
+// Returns the line numbers of the compounds by id and smiles
+func (catalog *Catalog) SearchIndex(fingerprintId string) (storage.SearchIndex, error) {
+	searchIndex, ok := catalog.searchIndices[fingerprintId]
+
+	if !ok || catalog.hides(fingerprintId) {
+		return nil, underdark.NewError(underdark.ErrUnknownFingerprint, "no search index loaded for fingerprint %s", fingerprintId)
+	}
+
+	return searchIndex, nil
+}
+
+// Returns the line numbers of the compounds in each bin
+func (catalog *Catalog) Bins(variantId string) ([][]uint32, error) {
+	indices, ok := catalog.variantIndices[variantId]
+
+	if !ok || catalog.hides(variantId) {
+		return nil, underdark.NewError(underdark.ErrUnknownVariant, "unknown variant %s", variantId)
+	}
+
+	return indices, nil
+}
+
+// Returns the approximate memory used by the bin contents of each variant
+// in bytes
+func (catalog *Catalog) IndicesSize() map[string]int64 {
+	sizes := map[string]int64{}
+
+	for variantId, size := range catalog.indicesSizes {
+		if !catalog.hides(variantId) {
+			sizes[variantId] = size
+		}
+	}
+
+	return sizes
+}
+
+// Returns the bin of each compound (line number), noBin if not binned
+func (catalog *Catalog) CompoundBins(variantId string) ([]uint32, error) {
+	bins, ok := catalog.compoundBins[variantId]
+
+	if !ok || catalog.hides(variantId) {
+		return nil, underdark.NewError(underdark.ErrUnknownVariant, "no bins loaded for variant %s", variantId)
+	}
+
+	return bins, nil
+}
+
+// Returns the coordinates of each bin
+func (catalog *Catalog) Coordinates(variantId string) ([]string, error) {
+	coordinates, ok := catalog.variantCoordinates[variantId]
+
+	if !ok || catalog.hides(variantId) {
+		return nil, underdark.NewError(underdark.ErrUnknownVariant, "no coordinates loaded for variant %s", variantId)
+	}
+
+	return coordinates, nil
+}
+
+// Returns the (non-empty) bin at each grid cell
+func (catalog *Catalog) Grid(variantId string) (map[GridCell]uint32, error) {
+	grid, ok := catalog.variantGrids[variantId]
+
+	if !ok || catalog.hides(variantId) {
+		return nil, underdark.NewError(underdark.ErrUnknownVariant, "no grid loaded for variant %s", variantId)
+	}
+
+	return grid, nil
+}
+
+// Loads the indices of the fingerprints and variants, returns the ids of
+// the variants that are new or have changed
+func loadIndices(catalog *Catalog, previous *Catalog) ([]string, error) {
+	var changed []string
+	var err error
+
+	loopConfig(&catalog.config, "", func(database *Database, path string) {
+		// Nothing to do here
+
+	}, func(fingerprint *Fingerprint, path string) {
+		if err == nil {
+			err = loadFingerprint(catalog, previous, fingerprint)
+		}
+
+	}, func(variant *Variant, path string) {
+		if err != nil {
+			return
+		}
+
+		var variantChanged bool
+		variantChanged, err = loadVariant(catalog, previous, variant)
+
+		if variantChanged {
+			changed = append(changed, variant.Id)
+		}
+
+	}, func(colorMap *ColorMap, path string) {
+		// Nothing to do here
+	}, false, false)
+
+	return changed, err
+}
+
+func loadFingerprint(catalog *Catalog, previous *Catalog, fingerprint *Fingerprint) error {
+	id := fingerprint.Id
+	unchanged := catalog.track(previous, fingerprint.InfosFile, fingerprint.InfoIndicesFile)
+
+	// The search index may have been written to the temporary directory,
+	// see loadSearchIndex
+	indexPath := fingerprint.SearchIndexFile
+
+	if index := previous.searchIndex(id); index != nil {
+		indexPath = index.Path()
+	}
+
+	if !catalog.track(previous, indexPath) {
+		unchanged = false
+	}
+
+	// Files are only unchanged if there is a previous catalog
+	if unchanged {
+		p, err := previous.Fingerprint(id)
+
+		if err == nil && p.InfosFile == fingerprint.InfosFile &&
+			p.InfoIndicesFile == fingerprint.InfoIndicesFile && p.SearchIndexFile == fingerprint.SearchIndexFile {
+			catalog.infoOffsets[id] = previous.infoOffsets[id]
+			catalog.infoLengths[id] = previous.infoLengths[id]
+			catalog.searchIndices[id] = previous.searchIndices[id]
+			dataLoads.Inc("fingerprint", "reused")
+			return nil
+		}
+	}
+
+	dataLoads.Inc("fingerprint", "loaded")
+
+	// Loading info indices and lengths
+	infosLength, err := storage.CountLines(fingerprint.InfoIndicesFile)
+
+	if err != nil {
+		return err
+	}
+
+	catalog.infoOffsets[id] = make([]uint64, infosLength)
+	catalog.infoLengths[id] = make([]uint32, infosLength)
+
+	underdark.Infof("Reading %s ...", fingerprint.InfoIndicesFile)
+
+	err = storage.ReadIndexFile(fingerprint.InfoIndicesFile, catalog.infoOffsets[id], catalog.infoLengths[id])
+
+	if err != nil {
+		return err
+	}
+
+	index, err := loadSearchIndex(fingerprint)
+
+	if err != nil {
+		return err
+	}
+
+	catalog.searchIndices[id] = index
+	catalog.track(nil, index.Path())
+
+	return nil
+}
+
+// Opens the search index file, it is built from the infos file if it does
+// not exist yet, is older than the infos file or was written unsorted by an
+// earlier version. If it cannot be written (e.g. the data directory is
+// read-only), it is written to the temporary directory instead.
+func loadSearchIndex(fingerprint *Fingerprint) (*storage.SearchIndexFile, error) {
+	paths := []string{fingerprint.SearchIndexFile, tempSearchIndexFile(fingerprint.SearchIndexFile)}
+
+	for _, path := range paths {
+		if !newer(path, fingerprint.InfosFile) {
+			continue
+		}
+
+		underdark.Infof("Opening %s ...", path)
+		index, err := storage.OpenSearchIndexFile(path)
+
+		if err == nil {
+			dataLoads.Inc("search_index", "loaded")
+			return index, nil
+		}
+
+		if err != storage.ErrUnsortedSearchIndex {
+			return nil, err
+		}
+	}
+
+	dataLoads.Inc("search_index", "built")
+
+	var err error
+
+	for _, path := range paths {
+		underdark.Infof("Building %s ...", path)
+		err = storage.BuildSearchIndexFile(fingerprint.InfosFile, path)
+
+		if err == nil {
+			return storage.OpenSearchIndexFile(path)
+		}
+
+		underdark.Errorf("Warning: could not write %s: %v", path, err)
+	}
+
+	return nil, err
+}
+
+// Returns the path of the search index file in the temporary directory,
+// used if it cannot be written next to the infos file
+func tempSearchIndexFile(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	hash := sha256.Sum256([]byte(path))
+
+	return filepath.Join(os.TempDir(), "underdark-"+hex.EncodeToString(hash[:8])+"-"+filepath.Base(path))
+}
+
+// Returns whether the file exists and has not been modified before the
+// other file
+func newer(path string, other string) bool {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return false
+	}
+
+	otherInfo, err := os.Stat(other)
+
+	return err == nil && !otherInfo.ModTime().After(info.ModTime())
+}
+
+// Returns whether the variant is new or any of its files (including the
+// maps) have changed
+func loadVariant(catalog *Catalog, previous *Catalog, variant *Variant) (bool, error) {
+	id := variant.Id
+	unchanged := catalog.track(previous, variant.IndicesFile, variant.CoordinatesFile, variant.BinsFile)
+
+	var p Variant
+	known := false
+
+	if previous != nil {
+		if v, err := previous.Variant(id); err == nil {
+			p, known = v, true
+		}
+	}
+
+	unchanged = unchanged && known && p.IndicesFile == variant.IndicesFile &&
+		p.CoordinatesFile == variant.CoordinatesFile && p.BinsFile == variant.BinsFile
+
+	// The maps are read on request, but the clients have to reload them too
+	mapsUnchanged := known && len(p.ColorMaps) == len(variant.ColorMaps)
+
+	for _, colorMap := range variant.ColorMaps {
+		if !catalog.track(previous, colorMap.MapFile) || previous.colorMaps[colorMap.Id].MapFile != colorMap.MapFile {
+			mapsUnchanged = false
+		}
+	}
+
+	if unchanged {
+		catalog.variantIndices[id] = previous.variantIndices[id]
+		catalog.indicesSizes[id] = previous.indicesSizes[id]
+		catalog.stats[id] = previous.stats[id]
+		catalog.compoundBins[id] = previous.compoundBins[id]
+		catalog.variantCoordinates[id] = previous.variantCoordinates[id]
+		catalog.variantGrids[id] = previous.variantGrids[id]
+		dataLoads.Inc("variant", "reused")
+		return !mapsUnchanged, nil
+	}
+
+	dataLoads.Inc("variant", "loaded")
+
+	// Loading the bin contents (indices pointing to the
+	// smiles and ids
+	indicesLength, err := storage.CountLines(variant.IndicesFile)
+
+	if err != nil {
+		return true, err
+	}
+
+	indices := make([][]uint32, indicesLength)
+
+	err = storage.ReadVariantIndexFile(variant.IndicesFile, indices)
+
+	if err != nil {
+		return true, err
+	}
+
+	catalog.variantIndices[id] = indices
+	catalog.indicesSizes[id] = calcIndicesSize(indices)
+	catalog.stats[id] = calcStats(indices)
+
+	// Loading the compound to bin lookup, it is calculated from the
+	// bin contents if no bins file is given
+	if variant.BinsFile != "" {
+		underdark.Infof("Reading %s ...", variant.BinsFile)
+		catalog.compoundBins[id], err = storage.ReadBinsFile(variant.BinsFile)
+	} else {
+		catalog.compoundBins[id], err = calcCompoundBins(indices)
+
+		if err != nil {
+			err = errors.New("invalid indices file " + variant.IndicesFile + ": " + err.Error())
+		}
+	}
+
+	if err != nil {
+		return true, err
+	}
+
+	underdark.Infof("Reading %s ...", variant.CoordinatesFile)
+
+	catalog.variantCoordinates[id], err = storage.ReadLines(variant.CoordinatesFile)
+
+	if err != nil {
+		return true, err
+	}
+
+	catalog.variantGrids[id] = calcGrid(indices, catalog.variantCoordinates[id])
+
+	return true, nil
+}
+
+// Returns the search index of the fingerprint, nil if there is no catalog
+func (catalog *Catalog) searchIndex(fingerprintId string) *storage.SearchIndexFile {
+	if catalog == nil {
+		return nil
+	}
+
+	return catalog.searchIndices[fingerprintId]
+}
+
+// Records the modification times of the files, returns true if all files
+// exist and have not been modified since the previous catalog was loaded.
+// Empty paths (optional files) are ignored.
+func (catalog *Catalog) track(previous *Catalog, paths ...string) bool {
+	unchanged := previous != nil
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+
+		if err != nil {
+			unchanged = false
+			continue
+		}
+
+		catalog.modTimes[path] = info.ModTime()
+
+		if previous == nil || !previous.modTimes[path].Equal(info.ModTime()) {
+			unchanged = false
+		}
+	}
+
+	return unchanged
+}
+
+// The files referenced in the config that do not exist
+type missingFilesError []string
+
+func (e missingFilesError) Error() string {
+	return "The following files were not found. Please add the files or remove the entries from the config.\n" +
+		strings.Join(e, "\n")
+}
+
+// Also prepends the paths to the file names
+func checkConfig(catalog *Catalog, dataDir string) error {
+	dataDirExists, _ := storage.Exists(dataDir)
+	if !dataDirExists {
+		return errors.New("The data directory '" + dataDir + "' does not exist.")
+	}
+
+	var nf missingFilesError
+	var err error
+
+	// The ids of the database, fingerprint and variant being checked
+	var databaseId, fingerprintId, variantId string
+
+	loopConfig(&catalog.config, dataDir, func(database *Database, path string) {
+		databaseId = database.Id
+		catalog.databases[database.Id] = *database
+	}, func(fingerprint *Fingerprint, path string) {
+		fingerprintId = fingerprint.Id
+		catalog.parents[fingerprint.Id] = databaseId
+		fingerprint.InfosFile = path + fingerprint.InfosFile
+
+		if exists, _ := storage.Exists(fingerprint.InfosFile); !exists {
+			nf = append(nf, fingerprint.InfosFile)
+		}
+
+		fingerprint.InfoIndicesFile = path + fingerprint.InfoIndicesFile
+
+		if exists, _ := storage.Exists(fingerprint.InfoIndicesFile); !exists {
+			nf = append(nf, fingerprint.InfoIndicesFile)
+		}
+
+		if fingerprint.Format != "" && fingerprint.Format != FormatValues && fingerprint.Format != FormatBits {
+			err = errors.New("The format of fingerprint " + fingerprint.Id + " has to be " + FormatValues + " or " + FormatBits + ".")
+		}
+
+		// The search index is optional, it is created on startup if missing
+		if fingerprint.SearchIndexFile == "" {
+			fingerprint.SearchIndexFile = fingerprint.InfosFile + ".search"
+		} else {
+			fingerprint.SearchIndexFile = path + fingerprint.SearchIndexFile
+		}
+
+		catalog.fingerprints[fingerprint.Id] = *fingerprint
+
+	}, func(variant *Variant, path string) {
+		variantId = variant.Id
+		catalog.parents[variant.Id] = fingerprintId
+		variant.IndicesFile = path + variant.IndicesFile
+		variant.CoordinatesFile = path + variant.CoordinatesFile
+
+		if exists, _ := storage.Exists(variant.IndicesFile); !exists {
+			nf = append(nf, variant.IndicesFile)
+		}
+
+		if exists, _ := storage.Exists(variant.CoordinatesFile); !exists {
+			nf = append(nf, variant.CoordinatesFile)
+		}
+
+		// The bins file is optional, the lookup is calculated if missing
+		if variant.BinsFile != "" {
+			variant.BinsFile = path + variant.BinsFile
+
+			if exists, _ := storage.Exists(variant.BinsFile); !exists {
+				nf = append(nf, variant.BinsFile)
+			}
+		}
+
+		catalog.variants[variant.Id] = *variant
+
+	}, func(colorMap *ColorMap, path string) {
+		catalog.parents[colorMap.Id] = variantId
+		colorMap.MapFile = path + colorMap.MapFile
+
+		if exists, _ := storage.Exists(colorMap.MapFile); !exists {
+			nf = append(nf, colorMap.MapFile)
+		}
+
+		catalog.colorMaps[colorMap.Id] = *colorMap
+	}, true, true)
+
+	if len(nf) > 0 {
+		return nf
+	}
+
+	return err
+}
+
+func calcStats(indices [][]uint32) Stats {
+	nBins := len(indices)
+	nCompounds := 0
+	max := 0
+	min := 9999
+
+	for i := 0; i < nBins; i++ {
+		n := len(indices[i])
+		nCompounds += n
+
+		if n > max {
+			max = n
+		}
+
+		if n < min {
+			min = n
+		}
+	}
+
+	var hist = make([]uint32, max+1)
+
+	// An empty variant has no average bin size
+	avgBinSize := float32(0)
+
+	if nBins > 0 {
+		avgBinSize = float32(nCompounds / nBins)
+	}
+
+	for i := 0; i < nBins; i++ {
+		n := len(indices[i])
+		hist[n]++
+	}
+
+	return Stats{
+		CompoundCount: uint32(nCompounds),
+		BinCount:      uint32(nBins),
+		AvgBinSize:    avgBinSize,
+		BinHist:       hist,
+		HistMin:       uint32(min),
+		HistMax:       uint32(max),
+	}
+}
+
+// Returns the approximate memory used by the bin contents in bytes, it is
+// calculated once since the catalog does not change
+func calcIndicesSize(indices [][]uint32) int64 {
+	// The slice headers and the line numbers
+	size := int64(24 * (len(indices) + 1))
+
+	for _, bin := range indices {
+		size += int64(4 * cap(bin))
+	}
+
+	return size
+}
+
+// Creates a dense array mapping each compound (line number) to the bin
+// containing it, compounds not in any bin are set to noBin. A compound can
+// only be in one bin.
+func calcCompoundBins(indices [][]uint32) ([]uint32, error) {
+	nBins := len(indices)
+	nCompounds := 0
+
+	for i := 0; i < nBins; i++ {
+		for _, compound := range indices[i] {
+			if int(compound) >= nCompounds {
+				nCompounds = int(compound) + 1
+			}
+		}
+	}
+
+	bins := make([]uint32, nCompounds)
+
+	for i := range bins {
+		bins[i] = storage.NoBin
+	}
+
+	for i := 0; i < nBins; i++ {
+		for _, compound := range indices[i] {
+			if bins[compound] != storage.NoBin {
+				return nil, fmt.Errorf("compound %d is in bins %d and %d", compound, bins[compound], i)
+			}
+
+			bins[compound] = uint32(i)
+		}
+	}
+
+	return bins, nil
+}
+
+// Maps the grid cell of each non-empty bin to the bin index
+func calcGrid(indices [][]uint32, coordinates []string) map[GridCell]uint32 {
+	grid := map[GridCell]uint32{}
+
+	for i, line := range coordinates {
+		if i >= len(indices) || len(indices[i]) == 0 {
+			continue
+		}
+
+		if cell, ok := ParseGridCell(line); ok {
+			grid[cell] = uint32(i)
+		}
+	}
+
+	return grid
+}
+
+// The coordinates of a bin are separated by commas or whitespace
+func ParseGridCell(line string) (GridCell, bool) {
+	var cell GridCell
+
+	values := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+
+	if len(values) < 3 {
+		return cell, false
+	}
+
+	for i := 0; i < 3; i++ {
+		value, err := strconv.ParseFloat(values[i], 64)
+
+		if err != nil {
+			return cell, false
+		}
+
+		cell[i] = int(math.Round(value))
+	}
+
+	return cell, true
+}
@@ -0,0 +1,246 @@
+package catalog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/reymond-group/underdarkgo/storage"
+)
+
+func TestCalcCompoundBins(t *testing.T) {
+	bins, err := calcCompoundBins([][]uint32{{0}, {}, {3, 1}})
+
+	if want := []uint32{0, 2, storage.NoBin, 2}; err != nil || !reflect.DeepEqual(bins, want) {
+		t.Errorf("calcCompoundBins() = %v, %v, want %v", bins, err, want)
+	}
+
+	// A compound cannot be in two bins
+	if _, err := calcCompoundBins([][]uint32{{0, 1}, {1}}); err == nil {
+		t.Errorf("calcCompoundBins() of a compound in two bins succeeded, want an error")
+	}
+}
+
+func TestCalcGrid(t *testing.T) {
+	// Empty bins and bins with invalid coordinates are not in the grid
+	grid := calcGrid([][]uint32{{0}, {}, {1}, {2}}, []string{"1,1,1", "2,2,2", "3.4 3 2.6", "a,b,c"})
+
+	if want := map[GridCell]uint32{{1, 1, 1}: 0, {3, 3, 3}: 2}; !reflect.DeepEqual(grid, want) {
+		t.Errorf("calcGrid() = %v, want %v", grid, want)
+	}
+}
+
+// Writes a data directory with the database db of two fingerprints fp1 and
+// fp2, each with a variant v of two bins and a map m (e.g. db.fp1.v.m). The
+// directory has to be removed by the caller.
+func testData(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "underdark")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint := `{"id": "%s", "directory": "%s", "infosFile": "i.info", "infoIndicesFile": "i.index",
+		"variants": [{"id": "v", "directory": "v", "resolution": 250,
+			"dataTypes": ["uint16", "uint16", "uint16"], "indicesFile": "v.dat", "coordinatesFile": "v.xyz",
+			"maps": [{"id": "m", "mapFile": "v.map", "dataTypes": ["float32", "float32", "float32"]}]}]}`
+
+	files := map[string]string{
+		"config.json": `{"databases": [{"id": "db", "directory": "db", "fingerprints": [` +
+			fmt.Sprintf(fingerprint, "fp1", "fp1") + ", " + fmt.Sprintf(fingerprint, "fp2", "fp2") + `]}]}`,
+	}
+
+	for _, fp := range []string{"fp1", "fp2"} {
+		files["db/"+fp+"/i.info"] = "ID1 CCO 1;2;3\nID2 c1ccccc1 4;5;6\n"
+		files["db/"+fp+"/i.index"] = "0,14\n14,20\n"
+		files["db/"+fp+"/v/v.dat"] = "0\n1\n"
+		files["db/"+fp+"/v/v.xyz"] = "1,1,1\n2,2,2\n"
+		files["db/"+fp+"/v/v.map"] = "0,0.5,1\n1,0.5,0\n"
+	}
+
+	for name, content := range files {
+		writeData(t, dir, name, content)
+	}
+
+	return dir
+}
+
+// Writes a file of the data directory, its modification time is moved
+// ahead so it differs from the time of the previous load
+func writeData(t *testing.T, dir string, name string, content string) {
+	path := filepath.Join(dir, name)
+	os.MkdirAll(filepath.Dir(path), 0755)
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	modTimeOffset += time.Second
+	modTime := time.Now().Add(modTimeOffset)
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Moves the modification times set by writeData ahead, so each is later
+// than the previous one
+var modTimeOffset time.Duration
+
+func loadTestData(t *testing.T, dir string, previous *Catalog) (*Catalog, []string, error) {
+	config, err := LoadConfig(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(dir, config, previous)
+}
+
+func TestNewReuse(t *testing.T) {
+	dir := testData(t)
+	defer os.RemoveAll(dir)
+
+	first, changed, err := loadTestData(t, dir, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"db.fp1.v", "db.fp2.v"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed variants of the first load = %v, want %v", changed, want)
+	}
+
+	// Nothing changed, all data is reused
+	second, changed, err := loadTestData(t, dir, first)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changed) != 0 {
+		t.Errorf("changed variants without changes = %v, want none", changed)
+	}
+
+	for _, id := range []string{"db.fp1", "db.fp2"} {
+		if second.searchIndices[id] != first.searchIndices[id] || &second.infoOffsets[id][0] != &first.infoOffsets[id][0] {
+			t.Errorf("data of fingerprint %s was loaded again, want it reused", id)
+		}
+
+		if &second.variantIndices[id+".v"][0] != &first.variantIndices[id+".v"][0] {
+			t.Errorf("data of variant %s.v was loaded again, want it reused", id)
+		}
+	}
+
+	// A changed map only reports the variant as changed, its data is reused
+	writeData(t, dir, "db/fp1/v/v.map", "1,0.5,0\n0,0.5,1\n")
+
+	third, changed, err := loadTestData(t, dir, second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"db.fp1.v"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed variants after changing a map = %v, want %v", changed, want)
+	}
+
+	if &third.variantIndices["db.fp1.v"][0] != &second.variantIndices["db.fp1.v"][0] {
+		t.Errorf("data of variant db.fp1.v was loaded again after changing its map, want it reused")
+	}
+
+	// A changed indices file is read again
+	writeData(t, dir, "db/fp2/v/v.dat", "1\n0\n")
+
+	fourth, changed, err := loadTestData(t, dir, third)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"db.fp2.v"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed variants after changing an indices file = %v, want %v", changed, want)
+	}
+
+	if bins, _ := fourth.CompoundBins("db.fp2.v"); !reflect.DeepEqual(bins, []uint32{1, 0}) {
+		t.Errorf("CompoundBins() after changing the indices file = %v, want [1 0]", bins)
+	}
+
+	if fourth.searchIndices["db.fp2"] != third.searchIndices["db.fp2"] {
+		t.Errorf("search index of db.fp2 was opened again, want it reused")
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"db/fp2/i.index", "0,14\n\n"},
+		{"db/fp2/i.index", "0,14\n14\n"},
+		{"db/fp2/i.index", "0,14\n14,a\n"},
+		{"db/fp2/v/v.dat", "0,a\n1\n"},
+		{"db/fp2/v/v.dat", "0\n0,1\n"},
+	}
+
+	for _, test := range tests {
+		dir := testData(t)
+
+		previous, _, err := loadTestData(t, dir, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writeData(t, dir, test.name, test.content)
+
+		if _, _, err := loadTestData(t, dir, previous); err == nil {
+			t.Errorf("New() with %s = %q succeeded, want an error", test.name, test.content)
+		}
+
+		// The previous catalog is still usable
+		if index, err := previous.SearchIndex("db.fp1"); err != nil {
+			t.Error(err)
+		} else if _, err := index.Lookup([]string{"ID1"}); err != nil {
+			t.Errorf("Lookup() in the previous catalog after a failed load error = %v", err)
+		}
+
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCloseSearchIndices(t *testing.T) {
+	dir := testData(t)
+	defer os.RemoveAll(dir)
+
+	previous, _, err := loadTestData(t, dir, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The search index of db.fp1 is reused, that of db.fp2 is new
+	index, err := storage.OpenSearchIndexFile(previous.fingerprints["db.fp2"].SearchIndexFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	catalog := empty(previous.config)
+	catalog.searchIndices["db.fp1"] = previous.searchIndices["db.fp1"]
+	catalog.searchIndices["db.fp2"] = index
+
+	catalog.closeSearchIndices(previous)
+
+	if _, err := previous.searchIndices["db.fp1"].Lookup([]string{"ID1"}); err != nil {
+		t.Errorf("Lookup() in the reused index error = %v, want it open", err)
+	}
+
+	if _, err := index.Lookup([]string{"ID1"}); err == nil {
+		t.Errorf("Lookup() in the new index succeeded, want it closed")
+	}
+}
@@ -0,0 +1,185 @@
+package catalog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+)
+
+type ColorMap struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	MapFile     string   `json:"mapFile"`
+	DataTypes   []string `json:"dataTypes"`
+}
+
+type Variant struct {
+	Id              string     `json:"id"`
+	Name            string     `json:"name"`
+	Description     string     `json:"description"`
+	Resolution      int        `json:"resolution"`
+	DataTypes       []string   `json:"dataTypes"`
+	Directory       string     `json:"directory"`
+	IndicesFile     string     `json:"indicesFile"`
+	CoordinatesFile string     `json:"coordinatesFile"`
+	BinsFile        string     `json:"binsFile"`
+	ColorMaps       []ColorMap `json:"maps"`
+}
+
+// The formats of the fingerprints in the infos file, values separated by
+// commas or semicolons (the default) or a string of bits, e.g. "0110..."
+const (
+	FormatValues = "values"
+	FormatBits   = "bits"
+)
+
+type Fingerprint struct {
+	Id              string    `json:"id"`
+	Name            string    `json:"name"`
+	Description     string    `json:"description"`
+	Directory       string    `json:"directory"`
+	InfosFile       string    `json:"infosFile"`
+	InfoIndicesFile string    `json:"infoIndicesFile"`
+	SearchIndexFile string    `json:"searchIndexFile"`
+	Format          string    `json:"format,omitempty"`
+	Variants        []Variant `json:"variants"`
+	Min             []float32 `json:"min"`
+	Max             []float32 `json:"max"`
+}
+
+type Database struct {
+	Id           string        `json:"id"`
+	Name         string        `json:"name"`
+	Description  string        `json:"description"`
+	Directory    string        `json:"directory"`
+	Fingerprints []Fingerprint `json:"fingerprints"`
+
+	// The names of the tokens and the roles that may access the database,
+	// anyone if empty
+	Access []string `json:"access,omitempty"`
+}
+
+// Returns whether the database may be accessed by a caller with any of the
+// given names (e.g. the name and roles of a token)
+func (database *Database) Allows(names []string) bool {
+	if len(database.Access) == 0 {
+		return true
+	}
+
+	for _, access := range database.Access {
+		for _, name := range names {
+			if access == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type Stats struct {
+	CompoundCount uint32   `json:"compoundCount"`
+	BinCount      uint32   `json:"binCount"`
+	AvgBinSize    float32  `json:"avgCompoundCount"`
+	BinHist       []uint32 `json:"binHist"`
+	HistMin       uint32   `json:"histMin"`
+	HistMax       uint32   `json:"histMax"`
+}
+
+type Configuration struct {
+	Databases []Database `json:"databases"`
+}
+
+// Reads config.json from the data directory
+func LoadConfig(dataDir string) (Configuration, error) {
+	if !strings.HasSuffix(dataDir, "/") {
+		dataDir += "/"
+	}
+
+	buffer, err := ioutil.ReadFile(dataDir + "config.json")
+
+	if err != nil {
+		return Configuration{}, err
+	}
+
+	var config Configuration
+	err = json.Unmarshal(buffer, &config)
+
+	if err != nil {
+		return Configuration{}, err
+	}
+
+	return config, nil
+}
+
+func loopConfig(config *Configuration, dataDir string, databaseCallback func(*Database, string),
+	fingerprintCallback func(*Fingerprint, string),
+	variantCallback func(*Variant, string),
+	colorMapCallback func(*ColorMap, string),
+	updatePath bool, updateId bool) {
+	for i, _ := range config.Databases {
+		database := &config.Databases[i]
+		var databasePath string
+		if updatePath {
+			databasePath = concatPath(dataDir, database.Directory)
+			databaseCallback(database, databasePath)
+		} else {
+			databaseCallback(database, database.Directory)
+		}
+		for j, _ := range database.Fingerprints {
+			fingerprint := &database.Fingerprints[j]
+			var fingerprintPath string
+			if updateId {
+				fingerprint.Id = database.Id + "." + fingerprint.Id
+			}
+			if updatePath {
+				fingerprintPath = concatPath(databasePath, fingerprint.Directory)
+				fingerprintCallback(fingerprint, fingerprintPath)
+			} else {
+				fingerprintCallback(fingerprint, fingerprint.Directory)
+			}
+
+			for k, _ := range fingerprint.Variants {
+				variant := &fingerprint.Variants[k]
+				var variantPath string
+				if updateId {
+					variant.Id = fingerprint.Id + "." + variant.Id
+				}
+				if updatePath {
+					variantPath = concatPath(fingerprintPath, variant.Directory)
+					variantCallback(variant, variantPath)
+				} else {
+					variantCallback(variant, variant.Directory)
+				}
+
+				for l, _ := range variant.ColorMaps {
+					colorMap := &variant.ColorMaps[l]
+					if updateId {
+						colorMap.Id = variant.Id + "." + colorMap.Id
+					}
+					if updatePath {
+						colorMapCallback(colorMap, variantPath)
+					} else {
+						colorMapCallback(colorMap, variant.Directory)
+					}
+
+				}
+			}
+		}
+	}
+}
+
+func concatPath(a string, b string) string {
+	if !strings.HasSuffix(a, "/") {
+		a += "/"
+	}
+	if strings.HasPrefix(b, "/") {
+		strings.TrimLeft(b, "/")
+	}
+	if !strings.HasSuffix(b, "/") {
+		b += "/"
+	}
+
+	return a + b
+}
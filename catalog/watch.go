@@ -0,0 +1,91 @@
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"runtime/debug"
+	"syscall"
+	"time"
+
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// How often config.json is checked for modifications
+const configPollInterval = 2 * time.Second
+
+// Loads config.json from the data directory and creates a catalog from it,
+// see New
+func Load(dataDir string, previous *Catalog) (*Catalog, []string, error) {
+	config, err := LoadConfig(dataDir)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return New(dataDir, config, previous)
+}
+
+// Loads the catalog like Load, a panic while loading is returned as an
+// error, so a bad data file cannot take down the server on reload
+func reload(dataDir string, current *Catalog) (catalog *Catalog, changed []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			underdark.Errorf("Panic during reloading: %v\n%s", r, debug.Stack())
+			catalog, changed, err = nil, nil, fmt.Errorf("panic during reloading: %v", r)
+		}
+	}()
+
+	return Load(dataDir, current)
+}
+
+// Reloads the catalog when config.json has been modified or the process
+// receives SIGHUP, reloaded is called with the new catalog and the ids of the
+// variants that are new or have changed. If the new configuration is invalid,
+// the error is logged and the current catalog is kept. Data files are only
+// checked for changes on reload, send SIGHUP after replacing them.
+func Watch(dataDir string, current *Catalog, reloaded func(*Catalog, []string)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	configFile := path.Join(dataDir, "config.json")
+
+	var modTime time.Time
+
+	if info, err := os.Stat(configFile); err == nil {
+		modTime = info.ModTime()
+	}
+
+	for {
+		select {
+		case <-hup:
+			underdark.Infof("Received SIGHUP")
+		case <-ticker.C:
+			info, err := os.Stat(configFile)
+
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+
+			modTime = info.ModTime()
+		}
+
+		underdark.Infof("Reloading %s ...", configFile)
+
+		catalog, changed, err := reload(dataDir, current)
+
+		if err != nil {
+			underdark.Errorf("Error during reloading, keeping the current config: %v", err)
+			continue
+		}
+
+		underdark.Infof("Reloaded config, %d variants changed", len(changed))
+
+		current = catalog
+		reloaded(catalog, changed)
+	}
+}
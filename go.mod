@@ -0,0 +1,5 @@
+module github.com/reymond-group/underdarkgo
+
+go 1.13
+
+require github.com/gorilla/websocket v1.5.3
@@ -0,0 +1,254 @@
+// Package metrics collects counters, gauges and histograms and serves them
+// in the Prometheus text format (ServeMetrics).
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The upper bounds of the buckets of latency histograms in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// A metric written by ServeMetrics
+type metric interface {
+	write(w io.Writer)
+}
+
+// The registered metrics in the order they are written
+var registry []metric
+var registryMutex sync.Mutex
+
+func register(m metric) {
+	registryMutex.Lock()
+	registry = append(registry, m)
+	registryMutex.Unlock()
+}
+
+// The values of a metric by label values, joined by labelSeparator
+type series struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mutex  sync.Mutex
+	values map[string]interface{}
+}
+
+const labelSeparator = "\xff"
+
+func newSeries(name string, help string, kind string, labels []string) *series {
+	return &series{name: name, help: help, kind: kind, labels: labels, values: map[string]interface{}{}}
+}
+
+// Returns the value for the label values, creates it with create if there
+// is none, s.mutex has to be held by the caller
+func (s *series) get(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(s.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", s.name, len(s.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, labelSeparator)
+	value, ok := s.values[key]
+
+	if !ok {
+		value = create()
+		s.values[key] = value
+	}
+
+	return value
+}
+
+// Returns the keys of the values in a stable order
+func (s *series) keys() []string {
+	keys := make([]string, 0, len(s.values))
+
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (s *series) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.kind)
+}
+
+// A counter per combination of label values
+type Counter struct {
+	*series
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{newSeries(name, help, "counter", labels)}
+	register(c)
+
+	return c
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value := c.get(labelValues, func() interface{} { return new(float64) }).(*float64)
+	*value += v
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.header(w)
+
+	for _, key := range c.keys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key), formatValue(*c.values[key].(*float64)))
+	}
+}
+
+// A histogram per combination of label values
+type Histogram struct {
+	*series
+	buckets []float64
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{newSeries(name, help, "histogram", labels), buckets}
+	register(h)
+
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	value := h.get(labelValues, func() interface{} {
+		return &histogramValue{counts: make([]uint64, len(h.buckets))}
+	}).(*histogramValue)
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			value.counts[i]++
+		}
+	}
+
+	value.count++
+	value.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.header(w)
+
+	labels := append(append([]string{}, h.labels...), "le")
+
+	for _, key := range h.keys() {
+		value := h.values[key].(*histogramValue)
+
+		// The bucket is given by the additional le label
+		prefix := key + labelSeparator
+
+		if len(h.labels) == 0 {
+			prefix = ""
+		}
+
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, prefix+formatValue(bound)), value.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, prefix+"+Inf"), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key), formatValue(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), value.count)
+	}
+}
+
+// A gauge whose values (by label values, joined by a comma) are collected
+// when the metrics are served
+type GaugeFunc struct {
+	*series
+	collect func() map[string]float64
+}
+
+func NewGaugeFunc(name string, help string, collect func() map[string]float64, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{newSeries(name, help, "gauge", labels), collect}
+	register(g)
+
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w)
+
+	values := g.collect()
+	keys := make([]string, 0, len(values))
+
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, strings.Replace(key, ",", labelSeparator, -1)), formatValue(values[key]))
+	}
+}
+
+// Escapes label values as required by the text format
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func formatLabels(labels []string, key string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	values := strings.Split(key, labelSeparator)
+	pairs := make([]string, len(labels))
+
+	for i, label := range labels {
+		pairs[i] = label + "=\"" + labelEscaper.Replace(values[i]) + "\""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Serves all registered metrics in the Prometheus text format
+func ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	registryMutex.Lock()
+	metrics := append([]metric{}, registry...)
+	registryMutex.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
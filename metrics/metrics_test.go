@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	requests := NewCounter("test_requests_total", "Requests.", "command", "code")
+	requests.Inc("load:bin", "ok")
+	requests.Add(2, "a\"b\\c\nd", "ok")
+
+	connections := NewCounter("test_connections_total", "Connections.")
+	connections.Add(0.5)
+	connections.Inc()
+
+	duration := NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1}, "command")
+	duration.Observe(0.05, "init")
+	duration.Observe(0.5, "init")
+	duration.Observe(2, "init")
+
+	sizes := NewHistogram("test_size_bytes", "Size.", []float64{10})
+	sizes.Observe(20)
+
+	variants := NewGaugeFunc("test_variant_bytes", "Variants.", func() map[string]float64 {
+		return map[string]float64{"db.fp.v,\"x\"": 1024, "db.fp.a,y": math.Inf(1)}
+	}, "variant", "name")
+
+	tests := []struct {
+		metric metric
+		want   string
+	}{
+		{requests, `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{command="a\"b\\c\nd",code="ok"} 2
+test_requests_total{command="load:bin",code="ok"} 1
+`},
+		{connections, `# HELP test_connections_total Connections.
+# TYPE test_connections_total counter
+test_connections_total 1.5
+`},
+		{duration, `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{command="init",le="0.1"} 1
+test_duration_seconds_bucket{command="init",le="1"} 2
+test_duration_seconds_bucket{command="init",le="+Inf"} 3
+test_duration_seconds_sum{command="init"} 2.55
+test_duration_seconds_count{command="init"} 3
+`},
+		{sizes, `# HELP test_size_bytes Size.
+# TYPE test_size_bytes histogram
+test_size_bytes_bucket{le="10"} 0
+test_size_bytes_bucket{le="+Inf"} 1
+test_size_bytes_sum 20
+test_size_bytes_count 1
+`},
+		{variants, `# HELP test_variant_bytes Variants.
+# TYPE test_variant_bytes gauge
+test_variant_bytes{variant="db.fp.a",name="y"} +Inf
+test_variant_bytes{variant="db.fp.v",name="\"x\""} 1024
+`},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		test.metric.write(&buf)
+
+		if buf.String() != test.want {
+			t.Errorf("write() =\n%s\nwant\n%s", buf.String(), test.want)
+		}
+	}
+}
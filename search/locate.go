@@ -0,0 +1,30 @@
+package search
+
+import "github.com/reymond-group/underdarkgo/storage"
+
+// The bin index of a line that is not in any bin
+const NotInBin = -1
+
+// Returns the bins (and their coordinates) containing the given lines, in
+// the order of the lines. Lines that are not in any bin get NotInBin and
+// empty coordinates, so each line has an entry.
+func Locate(bins []uint32, coordinates []string, lines []uint32) ([]int64, []string) {
+	binIndices := make([]int64, len(lines))
+	coords := make([]string, len(lines))
+
+	for i, line := range lines {
+		binIndices[i] = NotInBin
+
+		if int(line) >= len(bins) || bins[line] == storage.NoBin {
+			continue
+		}
+
+		binIndices[i] = int64(bins[line])
+
+		if int(bins[line]) < len(coordinates) {
+			coords[i] = coordinates[bins[line]]
+		}
+	}
+
+	return binIndices, coords
+}
@@ -0,0 +1,24 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/reymond-group/underdarkgo/storage"
+)
+
+func TestLocate(t *testing.T) {
+	bins := []uint32{1, storage.NoBin, 0}
+	coordinates := []string{"0,0,0", "1,1,1"}
+
+	// Lines without a bin and out of range are kept in place
+	binIndices, coords := Locate(bins, coordinates, []uint32{2, 1, 0, 5})
+
+	if want := []int64{0, NotInBin, 1, NotInBin}; !reflect.DeepEqual(binIndices, want) {
+		t.Errorf("Locate() bins = %v, want %v", binIndices, want)
+	}
+
+	if want := []string{"0,0,0", "", "1,1,1", ""}; !reflect.DeepEqual(coords, want) {
+		t.Errorf("Locate() coordinates = %q, want %q", coords, want)
+	}
+}
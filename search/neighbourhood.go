@@ -0,0 +1,139 @@
+package search
+
+import (
+	"context"
+	"sort"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// The largest radius of a neighbourhood in grid cells
+const MaxNeighbourhoodRadius = 100
+
+// Returns the non-empty bins (including the bin itself) within radius grid
+// cells of the given bin and the number of compounds they contain, ordered
+// by bin index. The radius has to be between 0 and MaxNeighbourhoodRadius,
+// which is checked when the request is validated.
+func Neighbourhood(ctx context.Context, c *catalog.Catalog, variantId string, binIndex int, radius int, cube bool) ([]uint32, []uint32, error) {
+	variant, err := c.Variant(variantId)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	grid, err := c.Grid(variantId)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	coordinates, err := c.Coordinates(variantId)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bins, err := c.Bins(variantId)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if binIndex < 0 || binIndex >= len(coordinates) || binIndex >= len(bins) {
+		return nil, nil, underdark.NewError(underdark.ErrBinOutOfRange, "binIndex %d is out of range", binIndex)
+	}
+
+	// The neighbourhood cannot be larger than the grid itself
+	if resolution := variant.Resolution; resolution > 0 && radius > resolution {
+		radius = resolution
+	}
+
+	center, ok := catalog.ParseGridCell(coordinates[binIndex])
+
+	if !ok {
+		return nil, nil, underdark.NewError(underdark.ErrIO, "invalid coordinates for bin %d: %s", binIndex, coordinates[binIndex])
+	}
+
+	binIndices, err := within(ctx, grid, center, radius, cube)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Slice(binIndices, func(a, b int) bool {
+		return binIndices[a] < binIndices[b]
+	})
+
+	binSizes := make([]uint32, len(binIndices))
+
+	for i, bin := range binIndices {
+		binSizes[i] = uint32(len(bins[bin]))
+	}
+
+	return binIndices, binSizes, nil
+}
+
+// Returns the bins in the grid within radius cells of the center (in a
+// sphere or cube)
+func within(ctx context.Context, grid map[catalog.GridCell]uint32, center catalog.GridCell, radius int, cube bool) ([]uint32, error) {
+	contains := func(cell catalog.GridCell) bool {
+		x, y, z := cell[0]-center[0], cell[1]-center[1], cell[2]-center[2]
+
+		if cube {
+			return abs(x) <= radius && abs(y) <= radius && abs(z) <= radius
+		}
+
+		return x*x+y*y+z*z <= radius*radius
+	}
+
+	binIndices := make([]uint32, 0)
+
+	// Look up each cell of the cube around the center, unless the cube has
+	// more cells than there are non-empty bins
+	if side := 2*radius + 1; side*side*side > len(grid) {
+		i := 0
+
+		for cell, bin := range grid {
+			if i%underdark.CancelCheckInterval == 0 && ctx.Err() != nil {
+				return nil, underdark.Cancelled(ctx)
+			}
+
+			if contains(cell) {
+				binIndices = append(binIndices, bin)
+			}
+
+			i++
+		}
+	} else {
+		for x := -radius; x <= radius; x++ {
+			if ctx.Err() != nil {
+				return nil, underdark.Cancelled(ctx)
+			}
+
+			for y := -radius; y <= radius; y++ {
+				for z := -radius; z <= radius; z++ {
+					cell := catalog.GridCell{center[0] + x, center[1] + y, center[2] + z}
+
+					if !contains(cell) {
+						continue
+					}
+
+					if bin, ok := grid[cell]; ok {
+						binIndices = append(binIndices, bin)
+					}
+				}
+			}
+		}
+	}
+
+	return binIndices, nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
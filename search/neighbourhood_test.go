@@ -0,0 +1,70 @@
+package search
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+func TestWithin(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	grid := map[catalog.GridCell]uint32{}
+
+	for i := uint32(0); len(grid) < 500; i++ {
+		grid[catalog.GridCell{r.Intn(20), r.Intn(20), r.Intn(20)}] = i
+	}
+
+	center := catalog.GridCell{10, 10, 10}
+
+	// Small radii look up the cells around the center, larger radii iterate
+	// the grid, both have to find the same bins
+	for radius := 0; radius <= 12; radius++ {
+		for _, cube := range []bool{false, true} {
+			var want []uint32
+
+			for cell, bin := range grid {
+				x, y, z := cell[0]-center[0], cell[1]-center[1], cell[2]-center[2]
+
+				if cube && abs(x) <= radius && abs(y) <= radius && abs(z) <= radius ||
+					!cube && x*x+y*y+z*z <= radius*radius {
+					want = append(want, bin)
+				}
+			}
+
+			got, err := within(context.Background(), grid, center, radius, cube)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sortBins(want)
+			sortBins(got)
+
+			if len(got) != len(want) || len(want) > 0 && !reflect.DeepEqual(got, want) {
+				t.Errorf("within(radius %d, cube %v) = %v, want %v", radius, cube, got, want)
+			}
+		}
+	}
+}
+
+func TestWithinCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := within(ctx, map[catalog.GridCell]uint32{{0, 0, 0}: 0}, catalog.GridCell{}, 1, false)
+
+	if e, ok := err.(*underdark.Error); !ok || e.Code != underdark.ErrCancelled {
+		t.Errorf("within() error = %v, want %s", err, underdark.ErrCancelled)
+	}
+}
+
+func sortBins(bins []uint32) {
+	sort.Slice(bins, func(a, b int) bool {
+		return bins[a] < bins[b]
+	})
+}
@@ -0,0 +1,203 @@
+// Package search implements the searches over the infos files and the bins
+// of a variant.
+package search
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/storage"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// The maximum number of hits returned by a substructure search and the
+// number of hits sent per partial response
+const MaxSubstructureHits = 100000
+const DefaultSubstructureHits = 10000
+const substructureChunkSize = 1000
+
+// Returns the bins of the compounds with the given ids or smiles, one list
+// of bins per term
+func Infos(ctx context.Context, c *catalog.Catalog, fingerprintId string, variantId string, terms []string) ([][]uint32, error) {
+	searchIndex, err := c.SearchIndex(fingerprintId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bins, err := c.CompoundBins(variantId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lines, err := searchIndex.Lookup(terms)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nTerms := len(terms)
+	binIndices := make([][]uint32, nTerms)
+
+	for i := 0; i < nTerms; i++ {
+		if ctx.Err() != nil {
+			return nil, underdark.Cancelled(ctx)
+		}
+
+		binIndices[i] = make([]uint32, 0)
+
+		underdark.ReportProgress(ctx, "searching", int64(i), int64(nTerms))
+
+		for _, line := range lines[i] {
+			if int(line) < len(bins) && bins[line] != storage.NoBin {
+				binIndices[i] = append(binIndices[i], bins[line])
+			}
+		}
+
+		// Keep the bins in ascending order, as returned by the full scan
+		sort.Slice(binIndices[i], func(a, b int) bool {
+			return binIndices[i][a] < binIndices[i][b]
+		})
+	}
+
+	underdark.ReportProgress(ctx, "searching", int64(nTerms), int64(nTerms))
+
+	return binIndices, nil
+}
+
+// Matches the queries against the smiles in the infos file and passes the
+// bins of the hits to send in chunks of substructureChunkSize hits
+func Substructure(ctx context.Context, c *catalog.Catalog, fingerprintId string, variantId string, terms []string, limit int,
+	send func([][]uint32, uint32, bool, bool) error) error {
+	fingerprint, err := c.Fingerprint(fingerprintId)
+
+	if err != nil {
+		return err
+	}
+
+	infoOffsets, _, err := c.InfoIndex(fingerprintId)
+
+	if err != nil {
+		return err
+	}
+
+	bins, err := c.CompoundBins(variantId)
+
+	if err != nil {
+		return err
+	}
+
+	nTerms := len(terms)
+	queries := make([]*molecule, nTerms)
+	screens := make([]screen, nTerms)
+
+	for i := 0; i < nTerms; i++ {
+		query, err := parseSmiles(terms[i], true)
+
+		if err != nil {
+			return underdark.NewError(underdark.ErrInvalidArgument, "invalid query %s: %v", terms[i], err)
+		}
+
+		queries[i] = query
+		screens[i] = query.screen()
+	}
+
+	r, err := os.Open(fingerprint.InfosFile)
+
+	if err != nil {
+		return underdark.NewError(underdark.ErrIO, "error opening %s: %v", fingerprint.InfosFile, err)
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+
+	const maxCapacity = 1024 * 1024
+	buf := make([]byte, maxCapacity)
+	scanner.Buffer(buf, maxCapacity)
+
+	binIndices := make([][]uint32, nTerms)
+	nHits := 0
+	nPending := 0
+
+	// Only set once a match beyond the limit has been seen
+	truncated := false
+
+	var line uint32
+	nLines := int64(len(infoOffsets))
+
+	for !truncated && scanner.Scan() {
+		if line%underdark.CancelCheckInterval == 0 {
+			if ctx.Err() != nil {
+				return underdark.Cancelled(ctx)
+			}
+
+			underdark.ReportProgress(ctx, "searching", int64(line), nLines)
+		}
+
+		values := strings.SplitN(scanner.Text(), " ", 3)
+
+		if len(values) < 2 || int(line) >= len(bins) || bins[line] == storage.NoBin {
+			line++
+			continue
+		}
+
+		// Only parse the smiles if it passes the screen of any query
+		targetScreen := smilesScreen(values[1])
+		var target *molecule
+
+		for i := 0; i < nTerms && !truncated; i++ {
+			if !screens[i].passes(&targetScreen) {
+				continue
+			}
+
+			if target == nil {
+				target, err = parseSmiles(values[1], false)
+
+				if err != nil {
+					if underdark.Debug {
+						fmt.Printf("Could not parse smiles %s on line %d: %v\n", values[1], line, err)
+					}
+					break
+				}
+			}
+
+			if queries[i].matches(target) {
+				if nHits >= limit {
+					truncated = true
+					break
+				}
+
+				binIndices[i] = append(binIndices[i], bins[line])
+				nHits++
+				nPending++
+			}
+		}
+
+		line++
+
+		if nPending >= substructureChunkSize {
+			if err := send(binIndices, line, false, false); err != nil {
+				return err
+			}
+
+			binIndices = make([][]uint32, nTerms)
+			nPending = 0
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return underdark.NewError(underdark.ErrIO, "error reading %s: %v", fingerprint.InfosFile, err)
+	}
+
+	underdark.ReportProgress(ctx, "searching", nLines, nLines)
+
+	return send(binIndices, line, truncated, true)
+}
@@ -0,0 +1,258 @@
+package search
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/storage"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// The maximum number of compounds returned by a similarity search
+const MaxSimilarHits = 10000
+const DefaultSimilarHits = 100
+
+type Hit struct {
+	Id       string
+	Smiles   string
+	Distance float64
+	Bin      uint32
+}
+
+// A max-heap on the distance, used to keep the k nearest neighbours
+type similarHits []Hit
+
+func (h similarHits) Len() int            { return len(h) }
+func (h similarHits) Less(i, j int) bool  { return h[i].Distance > h[j].Distance }
+func (h similarHits) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *similarHits) Push(x interface{}) { *h = append(*h, x.(Hit)) }
+func (h *similarHits) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// Returns the k compounds closest to the query fingerprint with a distance
+// below threshold, sorted by ascending distance, and whether more than k
+// compounds are within the threshold
+func Similar(ctx context.Context, c *catalog.Catalog, fingerprintId string, variantId string, fp string, metric string, k int,
+	threshold float64) ([]Hit, bool, error) {
+	fingerprint, err := c.Fingerprint(fingerprintId)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	query, err := ParseFingerprint(fp, fingerprint.Format)
+
+	if err != nil {
+		return nil, false, underdark.NewError(underdark.ErrInvalidArgument, "invalid query fingerprint: %v", err)
+	}
+
+	infoOffsets, _, err := c.InfoIndex(fingerprintId)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	bins, err := c.CompoundBins(variantId)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	distance, ok := distanceFunctions[metric]
+
+	if !ok {
+		return nil, false, underdark.NewError(underdark.ErrInvalidArgument, "unknown metric %s", metric)
+	}
+
+	if len(query) == 0 {
+		return nil, false, underdark.NewError(underdark.ErrInvalidArgument, "empty query fingerprint")
+	}
+
+	if k < 1 {
+		return nil, false, underdark.NewError(underdark.ErrInvalidArgument, "invalid number of neighbours %d", k)
+	}
+
+	r, err := os.Open(fingerprint.InfosFile)
+
+	if err != nil {
+		return nil, false, underdark.NewError(underdark.ErrIO, "error opening %s: %v", fingerprint.InfosFile, err)
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+
+	const maxCapacity = 1024 * 1024
+	buf := make([]byte, maxCapacity)
+	scanner.Buffer(buf, maxCapacity)
+
+	hits := &similarHits{}
+	truncated := false
+
+	nLines := int64(len(infoOffsets))
+
+	var line uint32
+	for scanner.Scan() {
+		if line%underdark.CancelCheckInterval == 0 {
+			if ctx.Err() != nil {
+				return nil, false, underdark.Cancelled(ctx)
+			}
+
+			underdark.ReportProgress(ctx, "searching", int64(line), nLines)
+		}
+
+		if int(line) >= len(bins) || bins[line] == storage.NoBin {
+			line++
+			continue
+		}
+
+		values := strings.SplitN(scanner.Text(), " ", 4)
+
+		if len(values) < 3 {
+			line++
+			continue
+		}
+
+		// Compounds with an invalid fingerprint are skipped like those without
+		target, err := ParseFingerprint(values[2], fingerprint.Format)
+
+		if err != nil {
+			line++
+			continue
+		}
+
+		d := distance(query, target)
+
+		if d <= threshold && hits.Len() >= k {
+			truncated = true
+		}
+
+		if d <= threshold && (hits.Len() < k || d < (*hits)[0].Distance) {
+			heap.Push(hits, Hit{
+				Id:       values[0],
+				Smiles:   values[1],
+				Distance: d,
+				Bin:      bins[line],
+			})
+
+			if hits.Len() > k {
+				heap.Pop(hits)
+			}
+		}
+
+		line++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, false, underdark.NewError(underdark.ErrIO, "error reading %s: %v", fingerprint.InfosFile, err)
+	}
+
+	underdark.ReportProgress(ctx, "searching", nLines, nLines)
+
+	result := make([]Hit, hits.Len())
+
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(hits).(Hit)
+	}
+
+	return result, truncated, nil
+}
+
+// Parses a fingerprint in the given format, see catalog.FormatValues and
+// catalog.FormatBits
+func ParseFingerprint(fp string, format string) ([]float64, error) {
+	if format == catalog.FormatBits {
+		bits := make([]float64, len(fp))
+
+		for i := 0; i < len(fp); i++ {
+			switch fp[i] {
+			case '0':
+			case '1':
+				bits[i] = 1
+			default:
+				return nil, fmt.Errorf("invalid bit %c", fp[i])
+			}
+		}
+
+		return bits, nil
+	}
+
+	values := strings.FieldsFunc(fp, func(r rune) bool {
+		return r == ',' || r == ';'
+	})
+
+	result := make([]float64, len(values))
+
+	for i, value := range values {
+		v, err := strconv.ParseFloat(value, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %s", value)
+		}
+
+		result[i] = v
+	}
+
+	return result, nil
+}
+
+// Distances between fingerprints, missing values are treated as zero
+var distanceFunctions = map[string]func([]float64, []float64) float64{
+	"cityblock": func(a []float64, b []float64) float64 {
+		var d float64
+
+		for i := 0; i < len(a) || i < len(b); i++ {
+			d += math.Abs(valueAt(a, i) - valueAt(b, i))
+		}
+
+		return d
+	},
+	"euclidean": func(a []float64, b []float64) float64 {
+		var d float64
+
+		for i := 0; i < len(a) || i < len(b); i++ {
+			diff := valueAt(a, i) - valueAt(b, i)
+			d += diff * diff
+		}
+
+		return math.Sqrt(d)
+	},
+	"tanimoto": func(a []float64, b []float64) float64 {
+		var ab, aa, bb float64
+
+		for i := 0; i < len(a) || i < len(b); i++ {
+			x := valueAt(a, i)
+			y := valueAt(b, i)
+			ab += x * y
+			aa += x * x
+			bb += y * y
+		}
+
+		if aa+bb-ab == 0 {
+			return 0
+		}
+
+		return 1 - ab/(aa+bb-ab)
+	},
+}
+
+func valueAt(values []float64, i int) float64 {
+	if i < len(values) {
+		return values[i]
+	}
+
+	return 0
+}
@@ -0,0 +1,51 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+)
+
+func TestParseFingerprint(t *testing.T) {
+	tests := []struct {
+		fp     string
+		format string
+		want   []float64
+	}{
+		{"1", "", []float64{1}},
+		{"10", "", []float64{10}},
+		{"0110", catalog.FormatValues, []float64{110}},
+		{"1;2;3", "", []float64{1, 2, 3}},
+		{"1,2.5,0", "", []float64{1, 2.5, 0}},
+		{"", "", []float64{}},
+		{"10", catalog.FormatBits, []float64{1, 0}},
+		{"0110", catalog.FormatBits, []float64{0, 1, 1, 0}},
+	}
+
+	for _, test := range tests {
+		got, err := ParseFingerprint(test.fp, test.format)
+
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseFingerprint(%q, %q) = %v, %v, want %v", test.fp, test.format, got, err, test.want)
+		}
+	}
+}
+
+func TestParseFingerprintInvalid(t *testing.T) {
+	tests := []struct {
+		fp     string
+		format string
+	}{
+		{"1;a;3", ""},
+		{"1 2", ""},
+		{"012", catalog.FormatBits},
+		{"1;0", catalog.FormatBits},
+	}
+
+	for _, test := range tests {
+		if got, err := ParseFingerprint(test.fp, test.format); err == nil {
+			t.Errorf("ParseFingerprint(%q, %q) = %v, want an error", test.fp, test.format, got)
+		}
+	}
+}
@@ -0,0 +1,603 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Bond orders, bondAromatic is used for bonds between two aromatic atoms
+// and for explicit ':' bonds. The query only orders match single or aromatic
+// bonds (the SMARTS default) or any bond ('~').
+const (
+	bondDefault  = -1
+	bondAny      = 0
+	bondSingle   = 1
+	bondDouble   = 2
+	bondTriple   = 3
+	bondQuad     = 5
+	bondAromatic = 4
+)
+
+type atom struct {
+	element   string
+	aromatic  bool
+	any       bool
+	charge    int
+	chargeSet bool
+}
+
+type bond struct {
+	a     int
+	b     int
+	order int
+}
+
+type neighbour struct {
+	atom  int
+	order int
+}
+
+type molecule struct {
+	atoms      []atom
+	bonds      []bond
+	neighbours [][]neighbour
+
+	// The order in which the atoms of a query are matched and the
+	// previously matched atom each atom is bonded to (-1 for the first atom
+	// of each component)
+	order   []int
+	parents []int
+}
+
+// The (heavy atom) screen is a count fingerprint of some elements and bond
+// types, a query can only match a target with equal or higher counts.
+const (
+	screenC = iota
+	screenAromaticC
+	screenN
+	screenAromaticN
+	screenO
+	screenAromaticO
+	screenS
+	screenAromaticS
+	screenP
+	screenF
+	screenCl
+	screenBr
+	screenI
+	screenOther
+	screenAtoms
+	screenDouble
+	screenTriple
+	screenSize
+)
+
+type screen [screenSize]uint16
+
+var elements = map[string]bool{}
+
+func init() {
+	for _, e := range strings.Fields(`H He Li Be B C N O F Ne Na Mg Al Si P S Cl Ar K Ca
+		Sc Ti V Cr Mn Fe Co Ni Cu Zn Ga Ge As Se Br Kr Rb Sr Y Zr Nb Mo Tc Ru Rh
+		Pd Ag Cd In Sn Sb Te I Xe Cs Ba La Ce Pr Nd Pm Sm Eu Gd Tb Dy Ho Er Tm Yb
+		Lu Hf Ta W Re Os Ir Pt Au Hg Tl Pb Bi Po At Rn Fr Ra Ac Th Pa U Np Pu Am
+		Cm Bk Cf Es Fm Md No Lr Rf Db Sg Bh Hs Mt Ds Rg Cn Nh Fl Mc Lv Ts Og`) {
+		elements[e] = true
+	}
+}
+
+// Parses a SMILES string. If query is true, the SMARTS extensions '*' (any
+// atom) and '~' (any bond) are allowed and bonds without a bond symbol match
+// both single and aromatic bonds.
+func parseSmiles(smiles string, query bool) (*molecule, error) {
+	mol := &molecule{}
+
+	prev := -1
+	pending := bondDefault
+	var stack []int
+
+	type ringBond struct {
+		atom  int
+		order int
+	}
+
+	rings := map[int]ringBond{}
+
+	addAtom := func(a atom) {
+		mol.atoms = append(mol.atoms, a)
+		mol.neighbours = append(mol.neighbours, nil)
+		current := len(mol.atoms) - 1
+
+		if prev >= 0 {
+			mol.addBond(prev, current, pending, query)
+		}
+
+		prev = current
+		pending = bondDefault
+	}
+
+	for i := 0; i < len(smiles); i++ {
+		c := smiles[i]
+
+		// A bond has to be followed by an atom or a ring closure
+		if pending != bondDefault && strings.IndexByte("()-/\\=#$:~.", c) >= 0 {
+			return nil, fmt.Errorf("unexpected '%c' after bond at position %d", c, i)
+		}
+
+		switch {
+		case c == '(':
+			if prev < 0 {
+				return nil, fmt.Errorf("branch without atom at position %d", i)
+			}
+			stack = append(stack, prev)
+		case c == ')':
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("unbalanced branch at position %d", i)
+			}
+			prev = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case c == '-':
+			pending = bondSingle
+		case c == '/' || c == '\\':
+			if !query {
+				pending = bondSingle
+			}
+		case c == '=':
+			pending = bondDouble
+		case c == '#':
+			pending = bondTriple
+		case c == '$':
+			pending = bondQuad
+		case c == ':':
+			pending = bondAromatic
+		case c == '~':
+			if !query {
+				return nil, fmt.Errorf("any bond is only allowed in queries")
+			}
+			pending = bondAny
+		case c == '.':
+			prev = -1
+		case c == '%' || (c >= '0' && c <= '9'):
+			n := int(c - '0')
+
+			if c == '%' {
+				if i+2 >= len(smiles) || !isDigit(smiles[i+1]) || !isDigit(smiles[i+2]) {
+					return nil, fmt.Errorf("invalid ring closure at position %d", i)
+				}
+
+				n = int(smiles[i+1]-'0')*10 + int(smiles[i+2]-'0')
+				i += 2
+			}
+
+			if prev < 0 {
+				return nil, fmt.Errorf("ring closure without atom at position %d", i)
+			}
+
+			if ring, ok := rings[n]; ok {
+				order := pending
+				if order == bondDefault {
+					order = ring.order
+				}
+
+				mol.addBond(ring.atom, prev, order, query)
+				delete(rings, n)
+			} else {
+				rings[n] = ringBond{atom: prev, order: pending}
+			}
+
+			pending = bondDefault
+		case c == '[':
+			end := strings.IndexByte(smiles[i:], ']')
+
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed bracket atom at position %d", i)
+			}
+
+			a, err := parseBracketAtom(smiles[i+1:i+end], query)
+
+			if err != nil {
+				return nil, err
+			}
+
+			addAtom(a)
+			i += end
+		case c == '*':
+			if !query {
+				return nil, fmt.Errorf("any atom is only allowed in queries")
+			}
+			addAtom(atom{any: true})
+		default:
+			a, n, ok := parseOrganicAtom(smiles[i:])
+
+			if !ok {
+				return nil, fmt.Errorf("unexpected character '%c' at position %d", c, i)
+			}
+
+			addAtom(a)
+			i += n - 1
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("unbalanced branch")
+	}
+
+	if pending != bondDefault {
+		return nil, fmt.Errorf("bond without atom at the end")
+	}
+
+	if len(rings) > 0 {
+		return nil, fmt.Errorf("unclosed ring")
+	}
+
+	if query {
+		mol.calcOrder()
+	}
+
+	return mol, nil
+}
+
+func (mol *molecule) addBond(a int, b int, order int, query bool) {
+	// Without explicit bond, a bond is aromatic if both atoms are aromatic,
+	// in queries the default bond is kept to match single or aromatic bonds
+	if order == bondDefault && !query {
+		if mol.atoms[a].aromatic && mol.atoms[b].aromatic {
+			order = bondAromatic
+		} else {
+			order = bondSingle
+		}
+	}
+
+	mol.bonds = append(mol.bonds, bond{a: a, b: b, order: order})
+	mol.neighbours[a] = append(mol.neighbours[a], neighbour{atom: b, order: order})
+	mol.neighbours[b] = append(mol.neighbours[b], neighbour{atom: a, order: order})
+}
+
+// Orders the atoms of a query breadth first, so that every atom (except the
+// first of each component) is bonded to an atom matched before
+func (mol *molecule) calcOrder() {
+	n := len(mol.atoms)
+	visited := make([]bool, n)
+	mol.order = make([]int, 0, n)
+	mol.parents = make([]int, 0, n)
+
+	for root := 0; root < n; root++ {
+		if visited[root] {
+			continue
+		}
+
+		visited[root] = true
+		mol.order = append(mol.order, root)
+		mol.parents = append(mol.parents, -1)
+
+		for k := len(mol.order) - 1; k < len(mol.order); k++ {
+			for _, nb := range mol.neighbours[mol.order[k]] {
+				if !visited[nb.atom] {
+					visited[nb.atom] = true
+					mol.order = append(mol.order, nb.atom)
+					mol.parents = append(mol.parents, mol.order[k])
+				}
+			}
+		}
+	}
+}
+
+func parseOrganicAtom(s string) (atom, int, bool) {
+	if len(s) > 1 && (s[:2] == "Cl" || s[:2] == "Br") {
+		return atom{element: s[:2]}, 2, true
+	}
+
+	switch s[0] {
+	case 'B', 'C', 'N', 'O', 'P', 'S', 'F', 'I':
+		return atom{element: s[:1]}, 1, true
+	case 'b', 'c', 'n', 'o', 'p', 's':
+		return atom{element: strings.ToUpper(s[:1]), aromatic: true}, 1, true
+	}
+
+	return atom{}, 0, false
+}
+
+// Parses the content of a bracket atom, e.g. "13CH3-", "nH" or "C@@H". The
+// isotope, chirality, hydrogen count and atom class are ignored.
+func parseBracketAtom(s string, query bool) (atom, error) {
+	a := atom{}
+	i := 0
+
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+
+	if i >= len(s) {
+		return a, fmt.Errorf("missing element in bracket atom [%s]", s)
+	}
+
+	switch {
+	case s[i] == '*':
+		if !query {
+			return a, fmt.Errorf("any atom is only allowed in queries")
+		}
+		a.any = true
+		i++
+	case s[i] >= 'A' && s[i] <= 'Z':
+		if i+1 < len(s) && elements[s[i:i+2]] {
+			a.element = s[i : i+2]
+			i += 2
+		} else {
+			a.element = s[i : i+1]
+			i++
+		}
+	case strings.HasPrefix(s[i:], "se") || strings.HasPrefix(s[i:], "as"):
+		a.element = strings.ToUpper(s[i:i+1]) + s[i+1:i+2]
+		a.aromatic = true
+		i += 2
+	case strings.IndexByte("bcnops", s[i]) >= 0:
+		a.element = strings.ToUpper(s[i : i+1])
+		a.aromatic = true
+		i++
+	default:
+		return a, fmt.Errorf("invalid element in bracket atom [%s]", s)
+	}
+
+	if !a.any && !elements[a.element] {
+		return a, fmt.Errorf("unknown element %s", a.element)
+	}
+
+	for i < len(s) && s[i] == '@' {
+		i++
+	}
+
+	if i < len(s) && s[i] == 'H' {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+	}
+
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		sign := 1
+		if s[i] == '-' {
+			sign = -1
+		}
+
+		a.chargeSet = true
+		a.charge = sign
+		i++
+
+		if i < len(s) && isDigit(s[i]) {
+			n := 0
+			for i < len(s) && isDigit(s[i]) {
+				n = n*10 + int(s[i]-'0')
+				i++
+			}
+			a.charge = sign * n
+		} else {
+			for i < len(s) && s[i] == s[i-1] {
+				a.charge += sign
+				i++
+			}
+		}
+	}
+
+	if i < len(s) && s[i] == ':' {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+	}
+
+	if i != len(s) {
+		return a, fmt.Errorf("invalid bracket atom [%s]", s)
+	}
+
+	return a, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Returns whether the query is a substructure of the target
+func (query *molecule) matches(target *molecule) bool {
+	if len(query.atoms) == 0 || len(query.atoms) > len(target.atoms) {
+		return false
+	}
+
+	mapping := make([]int, len(query.atoms))
+	used := make([]bool, len(target.atoms))
+
+	for i := range mapping {
+		mapping[i] = -1
+	}
+
+	return query.match(target, 0, mapping, used)
+}
+
+func (query *molecule) match(target *molecule, k int, mapping []int, used []bool) bool {
+	if k == len(query.order) {
+		return true
+	}
+
+	q := query.order[k]
+	parent := query.parents[k]
+
+	try := func(t int) bool {
+		if used[t] || !atomMatches(&query.atoms[q], &target.atoms[t]) {
+			return false
+		}
+
+		// All bonds to already matched atoms have to exist in the target
+		for _, nb := range query.neighbours[q] {
+			if mapping[nb.atom] >= 0 && !target.hasBond(t, mapping[nb.atom], nb.order) {
+				return false
+			}
+		}
+
+		mapping[q] = t
+		used[t] = true
+
+		if query.match(target, k+1, mapping, used) {
+			return true
+		}
+
+		mapping[q] = -1
+		used[t] = false
+
+		return false
+	}
+
+	if parent < 0 {
+		for t := range target.atoms {
+			if try(t) {
+				return true
+			}
+		}
+	} else {
+		for _, nb := range target.neighbours[mapping[parent]] {
+			if try(nb.atom) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (mol *molecule) hasBond(a int, b int, order int) bool {
+	for _, nb := range mol.neighbours[a] {
+		if nb.atom == b {
+			return bondMatches(order, nb.order)
+		}
+	}
+
+	return false
+}
+
+func atomMatches(q *atom, t *atom) bool {
+	if q.any {
+		return true
+	}
+
+	if q.element != t.element || q.aromatic != t.aromatic {
+		return false
+	}
+
+	return !q.chargeSet || q.charge == t.charge
+}
+
+func bondMatches(q int, t int) bool {
+	switch q {
+	case bondAny:
+		return true
+	case bondDefault:
+		return t == bondSingle || t == bondAromatic
+	}
+
+	return q == t
+}
+
+func (mol *molecule) screen() screen {
+	var s screen
+
+	for _, a := range mol.atoms {
+		s[screenAtoms]++
+
+		if !a.any {
+			s[screenIndex(a.element, a.aromatic)]++
+		}
+	}
+
+	for _, b := range mol.bonds {
+		if b.order == bondDouble {
+			s[screenDouble]++
+		} else if b.order == bondTriple {
+			s[screenTriple]++
+		}
+	}
+
+	return s
+}
+
+// Calculates the screen of a SMILES string without parsing the molecule
+func smilesScreen(smiles string) screen {
+	var s screen
+
+	for i := 0; i < len(smiles); i++ {
+		c := smiles[i]
+
+		switch {
+		case c == '=':
+			s[screenDouble]++
+		case c == '#':
+			s[screenTriple]++
+		case c == '[':
+			end := strings.IndexByte(smiles[i:], ']')
+			if end < 0 {
+				return s
+			}
+
+			if a, err := parseBracketAtom(smiles[i+1:i+end], false); err == nil {
+				s[screenAtoms]++
+				s[screenIndex(a.element, a.aromatic)]++
+			}
+
+			i += end
+		default:
+			if a, n, ok := parseOrganicAtom(smiles[i:]); ok {
+				s[screenAtoms]++
+				s[screenIndex(a.element, a.aromatic)]++
+				i += n - 1
+			}
+		}
+	}
+
+	return s
+}
+
+func screenIndex(element string, aromatic bool) int {
+	switch element {
+	case "C":
+		if aromatic {
+			return screenAromaticC
+		}
+		return screenC
+	case "N":
+		if aromatic {
+			return screenAromaticN
+		}
+		return screenN
+	case "O":
+		if aromatic {
+			return screenAromaticO
+		}
+		return screenO
+	case "S":
+		if aromatic {
+			return screenAromaticS
+		}
+		return screenS
+	case "P":
+		return screenP
+	case "F":
+		return screenF
+	case "Cl":
+		return screenCl
+	case "Br":
+		return screenBr
+	case "I":
+		return screenI
+	}
+
+	return screenOther
+}
+
+// Returns whether a target with the screen t can contain a query with the
+// screen q
+func (q *screen) passes(t *screen) bool {
+	for i := 0; i < screenSize; i++ {
+		if q[i] > t[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,264 @@
+package search
+
+import "testing"
+
+func TestParseSmiles(t *testing.T) {
+	tests := []struct {
+		smiles string
+		atoms  int
+		bonds  int
+	}{
+		{"C", 1, 0},
+		{"CCO", 3, 2},
+		{"C=C", 2, 1},
+		{"C#N", 2, 1},
+		{"CC(C)(C)O", 5, 4},
+		{"CC(=O)O", 4, 3},
+		{"C1CCCCC1", 6, 6},
+		{"C%10CCCCC%10", 6, 6},
+		{"C12CCC1CC2", 6, 7},
+		{"c1ccccc1", 6, 6},
+		{"c1ccc2ccccc2c1", 10, 11},
+		{"[NH4+]", 1, 0},
+		{"[13CH3-]", 1, 0},
+		{"[C@@H](F)(Cl)Br", 4, 3},
+		{"[nH]1cccc1", 5, 5},
+		{"[Na+].[Cl-]", 2, 0},
+		{"F/C=C/F", 4, 3},
+		{"ClCBr", 3, 2},
+	}
+
+	for _, test := range tests {
+		mol, err := parseSmiles(test.smiles, false)
+
+		if err != nil {
+			t.Errorf("parseSmiles(%q) error = %v", test.smiles, err)
+			continue
+		}
+
+		if len(mol.atoms) != test.atoms || len(mol.bonds) != test.bonds {
+			t.Errorf("parseSmiles(%q) has %d atoms and %d bonds, want %d and %d",
+				test.smiles, len(mol.atoms), len(mol.bonds), test.atoms, test.bonds)
+		}
+	}
+}
+
+func TestParseSmilesAtoms(t *testing.T) {
+	tests := []struct {
+		smiles string
+		want   atom
+	}{
+		{"C", atom{element: "C"}},
+		{"c", atom{element: "C", aromatic: true}},
+		{"Cl", atom{element: "Cl"}},
+		{"[Fe]", atom{element: "Fe"}},
+		{"[se]", atom{element: "Se", aromatic: true}},
+		{"[nH]", atom{element: "N", aromatic: true}},
+		{"[O-]", atom{element: "O", charge: -1, chargeSet: true}},
+		{"[Fe+3]", atom{element: "Fe", charge: 3, chargeSet: true}},
+		{"[Fe+++]", atom{element: "Fe", charge: 3, chargeSet: true}},
+		{"[O--]", atom{element: "O", charge: -2, chargeSet: true}},
+		{"[NH4+]", atom{element: "N", charge: 1, chargeSet: true}},
+		{"[2H]", atom{element: "H"}},
+		{"[CH3:1]", atom{element: "C"}},
+	}
+
+	for _, test := range tests {
+		mol, err := parseSmiles(test.smiles, false)
+
+		if err != nil {
+			t.Errorf("parseSmiles(%q) error = %v", test.smiles, err)
+			continue
+		}
+
+		if len(mol.atoms) != 1 || mol.atoms[0] != test.want {
+			t.Errorf("parseSmiles(%q) = %+v, want %+v", test.smiles, mol.atoms, test.want)
+		}
+	}
+}
+
+func TestParseSmilesBondOrders(t *testing.T) {
+	tests := []struct {
+		smiles string
+		query  bool
+		want   int
+	}{
+		{"CC", false, bondSingle},
+		{"cc", false, bondAromatic},
+		{"cC", false, bondSingle},
+		{"C=C", false, bondDouble},
+		{"C#C", false, bondTriple},
+		{"C:C", false, bondAromatic},
+		{"C/C", false, bondSingle},
+		{"CC", true, bondDefault},
+		{"cc", true, bondDefault},
+		{"C~C", true, bondAny},
+		{"C-C", true, bondSingle},
+	}
+
+	for _, test := range tests {
+		mol, err := parseSmiles(test.smiles, test.query)
+
+		if err != nil {
+			t.Errorf("parseSmiles(%q, %v) error = %v", test.smiles, test.query, err)
+			continue
+		}
+
+		if len(mol.bonds) != 1 || mol.bonds[0].order != test.want {
+			t.Errorf("parseSmiles(%q, %v) bonds = %+v, want order %d", test.smiles, test.query, mol.bonds, test.want)
+		}
+	}
+}
+
+func TestParseSmilesInvalid(t *testing.T) {
+	tests := []struct {
+		smiles string
+		query  bool
+	}{
+		{"C(", false},
+		{"C)", false},
+		{"(C)", false},
+		{"C1CC", false},
+		{"1CC", false},
+		{"C%1CC", false},
+		{"C[NH4", false},
+		{"C[]", false},
+		{"[Xx]", false},
+		{"[C+-]", false},
+		{"CX", false},
+		{"C*C", false},
+		{"C~C", false},
+		{"[*]", false},
+		{"CC=", false},
+		{"C=(O)C", false},
+		{"C(=)C", false},
+		{"C=.C", false},
+		{"C=#C", false},
+		{"C$$C", true},
+		{"c1cc(", true},
+	}
+
+	for _, test := range tests {
+		if _, err := parseSmiles(test.smiles, test.query); err == nil {
+			t.Errorf("parseSmiles(%q, %v) succeeded, want an error", test.smiles, test.query)
+		}
+	}
+}
+
+// The pairs are also used by TestScreen, every query that matches has to
+// pass the screen of its target
+var matchTests = []struct {
+	query  string
+	target string
+	want   bool
+}{
+	// Chains and branches
+	{"CC", "CCO", true},
+	{"CO", "CCO", true},
+	{"CCC", "CCO", false},
+	{"CC(C)C", "CC(C)(C)O", true},
+	{"CC(C)(C)C", "CC(C)CO", false},
+	{"C(=O)O", "CC(=O)O", true},
+	{"C=O", "CCO", false},
+	{"C#N", "CC#N", true},
+	{"C=C", "CC#C", false},
+	{"CC", "C.C", false},
+	{"C.C", "CCC", true},
+
+	// Ring closures
+	{"C1CC1", "C1CC1C", true},
+	{"C1CCC1", "C1CC1C", false},
+	{"CCCC", "C1CCC1", true},
+	{"C1CCCCC1", "C%10CCCCC%10", true},
+	{"C1CCCCC1", "C12CCCCC1CCCC2", true},
+	{"C1CCCC1", "C12CCCCC1CCCC2", false},
+
+	// Aromatic atoms
+	{"c1ccccc1", "Cc1ccccc1", true},
+	{"c1ccccc1", "C1=CC=CC=C1", false},
+	{"C1=CC=CC=C1", "c1ccccc1", false},
+	{"cc", "c1ccccc1", true},
+	{"cC", "Cc1ccccc1", true},
+	{"n1ccccc1", "c1ccncc1", true},
+	{"c1ccncc1", "c1ccccc1", false},
+	{"[nH]1cccc1", "c1cc[nH]c1C", true},
+	{"c1ccccc1O", "Oc1ccc(Cl)cc1", true},
+	{"c1ccc2ccccc2c1", "c1ccccc1", false},
+
+	// Charges and bracket atoms
+	{"[O-]", "CC(=O)[O-]", true},
+	{"[O-]", "CC(=O)O", false},
+	{"O", "CC(=O)[O-]", true},
+	{"[N+](=O)[O-]", "c1ccccc1[N+](=O)[O-]", true},
+	{"[NH4+]", "[NH4+].[Cl-]", true},
+	{"[Fe+2]", "[Fe+3]", false},
+	{"[Fe++]", "[Fe+2]", true},
+	{"[13C]", "CC", true},
+	{"Cl", "ClCBr", true},
+	{"Br", "CCl", false},
+
+	// Query extensions
+	{"*", "C", true},
+	{"C*C", "CNC", true},
+	{"C*C", "CN", false},
+	{"C~O", "C=O", true},
+	{"C~O", "CO", true},
+	{"C-c", "Cc1ccccc1", true},
+	{"c-c", "c1ccccc1", false},
+	{"c:c", "c1ccccc1", true},
+	{"C=C", "C=C", true},
+	{"C=C", "F/C=C/F", true},
+}
+
+func TestMatches(t *testing.T) {
+	for _, test := range matchTests {
+		query, err := parseSmiles(test.query, true)
+
+		if err != nil {
+			t.Errorf("parseSmiles(%q) error = %v", test.query, err)
+			continue
+		}
+
+		target, err := parseSmiles(test.target, false)
+
+		if err != nil {
+			t.Errorf("parseSmiles(%q) error = %v", test.target, err)
+			continue
+		}
+
+		if got := query.matches(target); got != test.want {
+			t.Errorf("%q matches %q = %v, want %v", test.query, test.target, got, test.want)
+		}
+	}
+}
+
+func TestScreen(t *testing.T) {
+	for _, test := range matchTests {
+		query, err := parseSmiles(test.query, true)
+
+		if err != nil {
+			continue
+		}
+
+		target, err := parseSmiles(test.target, false)
+
+		if err != nil {
+			continue
+		}
+
+		// The screen calculated without parsing has to be the screen of
+		// the parsed molecule
+		targetScreen := smilesScreen(test.target)
+
+		if parsedScreen := target.screen(); targetScreen != parsedScreen {
+			t.Errorf("smilesScreen(%q) = %v, want %v", test.target, targetScreen, parsedScreen)
+		}
+
+		// No false negatives
+		queryScreen := query.screen()
+
+		if query.matches(target) && !queryScreen.passes(&targetScreen) {
+			t.Errorf("%q matches %q but does not pass the screen", test.query, test.target)
+		}
+	}
+}
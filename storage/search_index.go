@@ -0,0 +1,461 @@
+package storage
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// Maps compound ids and smiles to line numbers in the infos file
+type SearchIndex interface {
+	// Returns the line numbers of each term, nil for unknown terms
+	Lookup(terms []string) ([][]uint32, error)
+}
+
+// The number of terms sorted in memory at a time while building a search
+// index file, the sorted runs are merged on disk
+var searchIndexRunSize = 1 << 21
+
+// A term and a line number of the infos file
+type searchIndexEntry struct {
+	term string
+	line uint32
+}
+
+// The first line of a search index file, files without it were written
+// unsorted by earlier versions
+const searchIndexHeader = "# underdark search index, sorted by term"
+
+// Returned by OpenSearchIndexFile for files written by earlier versions
+var ErrUnsortedSearchIndex = errors.New("search index file is not sorted")
+
+// Builds the search index file of an infos file, which maps both the id and
+// the smiles of each compound to its line number. The search index file
+// contains a header line followed by one term per line in ascending order
+// and the comma separated line numbers, e.g. "CCO 12,5077". The terms are
+// sorted in runs of searchIndexRunSize written next to the file and merged,
+// so the index is never held in memory. The file is replaced atomically,
+// catalogs that opened the previous file keep reading it.
+func BuildSearchIndexFile(infosPath string, path string) error {
+	r, err := os.Open(infosPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+
+	const maxCapacity = 1024 * 1024
+	buf := make([]byte, maxCapacity)
+	scanner.Buffer(buf, maxCapacity)
+
+	var runs []*os.File
+
+	defer func() {
+		for _, run := range runs {
+			run.Close()
+			os.Remove(run.Name())
+		}
+	}()
+
+	entries := make([]searchIndexEntry, 0, searchIndexRunSize)
+
+	var i uint32
+	for scanner.Scan() {
+		values := strings.SplitN(scanner.Text(), " ", 3)
+
+		for j := 0; j < len(values) && j < 2; j++ {
+			// Do not add the line twice if id and smiles are the same
+			if values[j] == "" || j == 1 && values[1] == values[0] {
+				continue
+			}
+
+			entries = append(entries, searchIndexEntry{values[j], i})
+		}
+
+		if len(entries) >= searchIndexRunSize {
+			if err := addSearchIndexRun(&runs, path, entries); err != nil {
+				return err
+			}
+
+			entries = entries[:0]
+		}
+
+		i++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(entries) > 0 || len(runs) == 0 {
+		if err := addSearchIndexRun(&runs, path, entries); err != nil {
+			return err
+		}
+	}
+
+	return mergeSearchIndexRuns(path, runs)
+}
+
+// Writes a run and adds it to the runs, which are removed by the caller
+func addSearchIndexRun(runs *[]*os.File, path string, entries []searchIndexEntry) error {
+	run, err := writeSearchIndexRun(path, entries)
+
+	if run != nil {
+		*runs = append(*runs, run)
+	}
+
+	return err
+}
+
+// Sorts the entries by term (keeping the line numbers in ascending order)
+// and writes them to a temporary file next to path, one entry per line
+func writeSearchIndexRun(path string, entries []searchIndexEntry) (*os.File, error) {
+	sort.SliceStable(entries, func(a, b int) bool {
+		return entries[a].term < entries[b].term
+	})
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".run")
+
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+
+	for _, entry := range entries {
+		w.WriteString(entry.term)
+		w.WriteByte(' ')
+		w.WriteString(strconv.FormatUint(uint64(entry.line), 10))
+		w.WriteByte('\n')
+	}
+
+	if err := w.Flush(); err != nil {
+		return f, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+
+	return f, err
+}
+
+// The next entry of each run, ordered by term and, since the runs hold
+// ascending line numbers, by run
+type searchIndexRuns []*searchIndexRun
+
+type searchIndexRun struct {
+	index   int
+	scanner *bufio.Scanner
+	entry   searchIndexEntry
+}
+
+func (runs searchIndexRuns) Len() int {
+	return len(runs)
+}
+
+func (runs searchIndexRuns) Less(a, b int) bool {
+	if runs[a].entry.term != runs[b].entry.term {
+		return runs[a].entry.term < runs[b].entry.term
+	}
+
+	return runs[a].index < runs[b].index
+}
+
+func (runs searchIndexRuns) Swap(a, b int) {
+	runs[a], runs[b] = runs[b], runs[a]
+}
+
+func (runs *searchIndexRuns) Push(v interface{}) {
+	*runs = append(*runs, v.(*searchIndexRun))
+}
+
+func (runs *searchIndexRuns) Pop() interface{} {
+	old := *runs
+	run := old[len(old)-1]
+	*runs = old[:len(old)-1]
+
+	return run
+}
+
+// Reads the next entry of the run, returns false at the end of the run
+func (run *searchIndexRun) next() (bool, error) {
+	if !run.scanner.Scan() {
+		return false, run.scanner.Err()
+	}
+
+	line := run.scanner.Text()
+	sep := strings.LastIndexByte(line, ' ')
+	n, err := strconv.ParseUint(line[sep+1:], 10, 32)
+
+	if sep < 0 || err != nil {
+		return false, errors.New("invalid search index run " + line)
+	}
+
+	run.entry = searchIndexEntry{line[:sep], uint32(n)}
+
+	return true, nil
+}
+
+// Merges the sorted runs into the search index file, the line numbers of
+// a term are combined on one line
+func mergeSearchIndexRuns(path string, files []*os.File) error {
+	f, err := createTemp(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	runs := searchIndexRuns{}
+
+	for i, file := range files {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		run := &searchIndexRun{index: i, scanner: scanner}
+
+		ok, err := run.next()
+
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			runs = append(runs, run)
+		}
+	}
+
+	heap.Init(&runs)
+
+	w := bufio.NewWriter(f)
+	w.WriteString(searchIndexHeader + "\n")
+
+	previous := ""
+	first := true
+
+	for len(runs) > 0 {
+		run := runs[0]
+
+		if first || run.entry.term != previous {
+			if !first {
+				w.WriteByte('\n')
+			}
+
+			w.WriteString(run.entry.term)
+			w.WriteByte(' ')
+			previous = run.entry.term
+			first = false
+		} else {
+			w.WriteByte(',')
+		}
+
+		w.WriteString(strconv.FormatUint(uint64(run.entry.line), 10))
+
+		ok, err := run.next()
+
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			heap.Fix(&runs, 0)
+		} else {
+			heap.Pop(&runs)
+		}
+	}
+
+	if !first {
+		w.WriteByte('\n')
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Creates a temporary file next to path, so it can be renamed to path. The
+// name is unique, so concurrent builds of the same file do not overwrite
+// each other.
+func createTemp(path string) (*os.File, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// A search index file, the terms are looked up by binary search on disk
+// instead of loading the index into memory. The file is kept open until
+// Close is called, so replacing it does not affect the lookups. A catalog
+// that is replaced on reload does not close its indices, since connections
+// may still be served from it, the file is closed by the runtime once the
+// index is no longer referenced.
+type SearchIndexFile struct {
+	path string
+	file *os.File
+
+	// The offset of the first term (after the header) and the file size
+	start int64
+	size  int64
+}
+
+// Opens a search index file written by BuildSearchIndexFile, returns
+// ErrUnsortedSearchIndex for files written by earlier versions
+func OpenSearchIndexFile(path string) (*SearchIndexFile, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	header, err := bufio.NewReader(f).ReadString('\n')
+
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+
+	if strings.TrimSuffix(header, "\n") != searchIndexHeader {
+		f.Close()
+		return nil, ErrUnsortedSearchIndex
+	}
+
+	return &SearchIndexFile{path: path, file: f, start: int64(len(header)), size: info.Size()}, nil
+}
+
+// Closes the file, the index cannot be used afterwards
+func (index *SearchIndexFile) Close() error {
+	return index.file.Close()
+}
+
+// The path the index was opened from
+func (index *SearchIndexFile) Path() string {
+	return index.path
+}
+
+func (index *SearchIndexFile) Lookup(terms []string) ([][]uint32, error) {
+	lines := make([][]uint32, len(terms))
+
+	for i, term := range terms {
+		var err error
+		lines[i], err = index.find(term)
+
+		if err != nil {
+			return nil, underdark.NewError(underdark.ErrIO, "error reading %s: %v", index.path, err)
+		}
+	}
+
+	return lines, nil
+}
+
+// Finds the smallest offset whose next line has a term not less than the
+// given term, the line numbers of that line are returned if its term matches
+func (index *SearchIndexFile) find(term string) ([]uint32, error) {
+	lo, hi := index.start, index.size
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		line, err := index.lineAt(mid)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if line != "" && lineTerm(line) < term {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	line, err := index.lineAt(lo)
+
+	if err != nil || line == "" || lineTerm(line) != term {
+		return nil, err
+	}
+
+	if len(line) == len(term) {
+		return nil, nil
+	}
+
+	values := strings.Split(line[len(term)+1:], ",")
+	lines := make([]uint32, len(values))
+
+	for i, value := range values {
+		n, err := strconv.ParseUint(value, 10, 32)
+
+		if err != nil {
+			return nil, errors.New("invalid line number " + value + " for " + term)
+		}
+
+		lines[i] = uint32(n)
+	}
+
+	return lines, nil
+}
+
+// Returns the first line starting at or after the offset (without the
+// newline), an empty string if there is none. The byte before the first
+// term is the newline ending the header.
+func (index *SearchIndexFile) lineAt(offset int64) (string, error) {
+	r := bufio.NewReader(io.NewSectionReader(index.file, offset-1, index.size-offset+1))
+
+	// Skip the rest of the line the offset is in
+	if _, err := r.ReadString('\n'); err != nil {
+		if err == io.EOF {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	line, err := r.ReadString('\n')
+
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+func lineTerm(line string) string {
+	if sep := strings.IndexByte(line, ' '); sep >= 0 {
+		return line[:sep]
+	}
+
+	return line
+}
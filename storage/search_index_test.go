@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSearchIndexFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "underdark")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// The infos file and the line numbers of each id and smiles
+	infos := "ZINC00001 C 1\nZINC00002 CC 2\nID0 CC(C)O 3\nCCO CCO 4\nID1 CCO 5\nID2 CCO 6\n" +
+		"ID3 c1ccccc1 7\nID4 CC 8\n"
+	want := map[string][]uint32{
+		"ZINC00001": {0}, "C": {0}, "ZINC00002": {1}, "CC": {1, 7}, "ID0": {2}, "CC(C)O": {2},
+		"CCO": {3, 4, 5}, "ID1": {4}, "ID2": {5}, "ID3": {6}, "c1ccccc1": {6}, "ID4": {7},
+	}
+
+	// Enough terms that the lookups cross many lines of different length
+	for i := 0; i < 500; i++ {
+		id := "X" + strconv.Itoa(i*7)
+		infos += id + " C" + strconv.Itoa(i) + " 0\n"
+		want[id] = []uint32{uint32(8 + i)}
+		want["C"+strconv.Itoa(i)] = []uint32{uint32(8 + i)}
+	}
+
+	infosPath := filepath.Join(dir, "infos")
+
+	if err := ioutil.WriteFile(infosPath, []byte(infos), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var terms []string
+
+	for term := range want {
+		terms = append(terms, term)
+	}
+
+	// Unknown terms before, between and after the known terms
+	terms = append(terms, "", "A", "CC(", "CCOC", "ID5", "X99999", "ZINC00003", "zzz")
+
+	// Sorted in memory at once and merged from many runs
+	for _, runSize := range []int{1 << 21, 7} {
+		searchIndexRunSize = runSize
+		path := filepath.Join(dir, "infos.search")
+
+		if err := BuildSearchIndexFile(infosPath, path); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := OpenSearchIndexFile(path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := file.Lookup(terms)
+		file.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, term := range terms {
+			if !reflect.DeepEqual(got[i], want[term]) {
+				t.Errorf("Lookup(%q) with runs of %d = %v, want %v", term, runSize, got[i], want[term])
+			}
+		}
+	}
+
+	searchIndexRunSize = 1 << 21
+
+	// The runs are removed
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("%d files left in the directory, want 2", len(files))
+	}
+}
+
+func TestSearchIndexFileReplaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "underdark")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	infosPath := filepath.Join(dir, "infos")
+	path := filepath.Join(dir, "infos.search")
+
+	ioutil.WriteFile(infosPath, []byte("ID1 CCO 1\n"), 0644)
+
+	if err := BuildSearchIndexFile(infosPath, path); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := OpenSearchIndexFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	// The opened index keeps reading the file it was opened from
+	ioutil.WriteFile(infosPath, []byte("ID2 CC 1\nID1 CCO 1\n"), 0644)
+
+	if err := BuildSearchIndexFile(infosPath, path); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := file.Lookup([]string{"ID1", "ID2"})
+
+	if err != nil || !reflect.DeepEqual(got, [][]uint32{{0}, nil}) {
+		t.Errorf("Lookup() after replacing the file = %v, %v, want [[0] []]", got, err)
+	}
+}
+
+func TestBuildSearchIndexFileConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "underdark")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	infosPath := filepath.Join(dir, "infos")
+	path := filepath.Join(dir, "infos.search")
+
+	ioutil.WriteFile(infosPath, []byte("ID1 CCO 1\nID2 CC 1\n"), 0644)
+
+	// Each build writes its own temporary file before replacing the index
+	errs := make(chan error, 4)
+
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- BuildSearchIndexFile(infosPath, path)
+		}()
+	}
+
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := OpenSearchIndexFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	got, err := file.Lookup([]string{"ID1", "CC"})
+
+	if err != nil || !reflect.DeepEqual(got, [][]uint32{{0}, {1}}) {
+		t.Errorf("Lookup() = %v, %v, want [[0] [1]]", got, err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("%d files left in the directory, want 2", len(files))
+	}
+}
+
+func TestOpenUnsortedSearchIndexFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "underdark")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+
+	f.WriteString("CCO 3,4\nC 0\n")
+	f.Close()
+
+	if _, err := OpenSearchIndexFile(f.Name()); err != ErrUnsortedSearchIndex {
+		t.Errorf("OpenSearchIndexFile() error = %v, want %v", err, ErrUnsortedSearchIndex)
+	}
+}
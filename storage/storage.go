@@ -0,0 +1,246 @@
+// Package storage reads the index files of the data directory and builds
+// the search index.
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// The size of the blocks in which files are read when reporting progress
+const readBlockSize = 4 * 1024 * 1024
+
+// The bin of the compounds not in any bin
+const NoBin = ^uint32(0)
+
+// Reads a file in blocks, reporting the progress and checking for
+// cancellation after each block
+func ReadFile(ctx context.Context, path string) ([]byte, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, underdark.NewError(underdark.ErrIO, "error opening %s: %v", path, err)
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return nil, underdark.NewError(underdark.ErrIO, "error opening %s: %v", path, err)
+	}
+
+	size := info.Size()
+	buf := make([]byte, size)
+
+	for offset := int64(0); offset < size; {
+		if ctx.Err() != nil {
+			return nil, underdark.Cancelled(ctx)
+		}
+
+		end := offset + readBlockSize
+
+		if end > size {
+			end = size
+		}
+
+		n, err := file.ReadAt(buf[offset:end], offset)
+		offset += int64(n)
+
+		if err != nil && !(err == io.EOF && offset == size) {
+			return nil, underdark.NewError(underdark.ErrIO, "error reading %s: %v", path, err)
+		}
+
+		underdark.ReportProgress(ctx, "reading", offset, size)
+	}
+
+	return buf, nil
+}
+
+func Exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, err
+}
+
+func CountLines(path string) (int, error) {
+	r, err := os.Open(path)
+
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	buf := make([]byte, 32*1024)
+	count := 0
+	lineSep := []byte{'\n'}
+
+	for {
+		c, err := r.Read(buf)
+		count += bytes.Count(buf[:c], lineSep)
+
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+	}
+}
+
+// Reads the offset and length of each line of the infos file, one line per
+// compound with the comma separated offset and length
+func ReadIndexFile(path string, offsets []uint64, lengths []uint32) error {
+	r, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+
+	i := 0
+	for scanner.Scan() && i < len(offsets) {
+		line := scanner.Text()
+		values := strings.Split(line, ",")
+
+		if len(values) != 2 {
+			return fmt.Errorf("invalid offset and length on line %d of %s: %q", i, path, line)
+		}
+
+		offset, err := strconv.ParseUint(values[0], 10, 64)
+
+		if err != nil {
+			return fmt.Errorf("invalid offset on line %d of %s: %v", i, path, err)
+		}
+
+		length, err := strconv.ParseUint(values[1], 10, 32)
+
+		if err != nil {
+			return fmt.Errorf("invalid length on line %d of %s: %v", i, path, err)
+		}
+
+		offsets[i] = uint64(offset)
+		lengths[i] = uint32(length)
+
+		i++
+	}
+
+	return scanner.Err()
+}
+
+// Reads the line numbers of the compounds in each bin, one bin per line
+// with comma separated line numbers. An empty line is an empty bin.
+func ReadVariantIndexFile(path string, indices [][]uint32) error {
+	r, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+
+	// The buffer in the scanner is to small for large bins, so increase it a bit
+	// Set the buffer size to 1024 * 1024 bytes (1 MB) ~ 1 million characters
+	const maxCapacity = 1024 * 1024
+	buf := make([]byte, maxCapacity)
+	scanner.Buffer(buf, maxCapacity)
+
+	i := 0
+	for scanner.Scan() && i < len(indices) {
+		line := scanner.Text()
+
+		if line == "" {
+			indices[i] = []uint32{}
+			i++
+			continue
+		}
+
+		values := strings.Split(line, ",")
+		n := len(values)
+		indices[i] = make([]uint32, n)
+
+		for j := 0; j < n; j++ {
+			value, err := strconv.ParseUint(values[j], 10, 32)
+
+			if err != nil {
+				return fmt.Errorf("invalid line number on line %d of %s: %v", i, path, err)
+			}
+
+			indices[i][j] = uint32(value)
+		}
+
+		i++
+	}
+
+	return scanner.Err()
+}
+
+// The bins file contains one bin index per line, the line number being the
+// line number of the compound in the infos file
+func ReadBinsFile(path string) ([]uint32, error) {
+	lines, err := ReadLines(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bins := make([]uint32, len(lines))
+
+	for i, line := range lines {
+		if line == "" {
+			bins[i] = NoBin
+			continue
+		}
+
+		bin, err := strconv.ParseUint(line, 10, 32)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid bin index on line %d of %s: %v", i, path, err)
+		}
+
+		bins[i] = uint32(bin)
+	}
+
+	return bins, nil
+}
+
+func ReadLines(path string) ([]string, error) {
+	r, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+
+	const maxCapacity = 1024 * 1024
+	buf := make([]byte, maxCapacity)
+	scanner.Buffer(buf, maxCapacity)
+
+	lines := make([]string, 0)
+
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines, scanner.Err()
+}
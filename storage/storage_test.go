@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Writes the content to a file in a temporary directory, which has to be
+// removed by the caller
+func writeTemp(t *testing.T, content string) (string, string) {
+	dir, err := ioutil.TempDir("", "underdark")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "file")
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return dir, path
+}
+
+func TestReadVariantIndexFile(t *testing.T) {
+	dir, path := writeTemp(t, "0,2\n\n1\n")
+	defer os.RemoveAll(dir)
+
+	indices := make([][]uint32, 3)
+
+	if err := ReadVariantIndexFile(path, indices); err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty line is an empty bin
+	if want := [][]uint32{{0, 2}, {}, {1}}; !reflect.DeepEqual(indices, want) {
+		t.Errorf("ReadVariantIndexFile() = %v, want %v", indices, want)
+	}
+}
+
+func TestReadVariantIndexFileInvalid(t *testing.T) {
+	for _, content := range []string{"0,a\n", "0,\n", "-1\n", "4294967296\n"} {
+		dir, path := writeTemp(t, content)
+
+		if err := ReadVariantIndexFile(path, make([][]uint32, 1)); err == nil {
+			t.Errorf("ReadVariantIndexFile(%q) succeeded, want an error", content)
+		}
+
+		os.RemoveAll(dir)
+	}
+}
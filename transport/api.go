@@ -0,0 +1,397 @@
+package transport
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+const ApiPrefix = "/api/v1/"
+
+// Serves the WebSocket commands as REST endpoints, using the same handler
+// functions:
+//
+//	GET /api/v1/init                                              init
+//	GET /api/v1/variants/{variant}                                load:variant
+//	GET /api/v1/variants/{variant}/stats                          load:stats
+//	GET /api/v1/maps/{map}                                        load:map
+//	GET /api/v1/fingerprints/{fp}/variants/{variant}/bins/{bins}  load:bin
+//	GET /api/v1/fingerprints/{fp}/variants/{variant}/bins/{bin}/preview
+//	                                                              load:binpreview
+//	GET /api/v1/fingerprints/{fp}/variants/{variant}/search?q=... search:infos
+//
+// Bins are comma separated, load:bin accepts the query parameters offset
+// and limit. Responses are JSON, variants and maps are also available as
+// text/plain (the raw file) and application/octet-stream (typed arrays).
+// Requests are authenticated like WebSocket connections, see authenticate.
+func (s *Server) ServeApi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		apiError(w, http.StatusMethodNotAllowed, underdark.ErrInvalidArgument, "method not allowed")
+		return
+	}
+
+	defer apiRecover(w, r)
+
+	identity, ok := s.authenticateHTTP(w, r)
+
+	if !ok || !s.apiRateLimit(w, r, identity) {
+		return
+	}
+
+	// API requests count towards the global limit of concurrent requests
+	select {
+	case s.requestSlots <- struct{}{}:
+		defer func() { <-s.requestSlots }()
+	case <-r.Context().Done():
+		apiHandlerError(w, underdark.Cancelled(r.Context()))
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, ApiPrefix), "/"), "/")
+
+	// Every request is served from one catalog, even if it is replaced
+	// meanwhile, restricted to the databases the caller may access
+	catalog := restrict(s.currentCatalog(), identity)
+
+	switch {
+	case len(path) == 1 && path[0] == "init":
+		response, err := underdarkInit(catalog, nil, "")
+		apiJSON(w, r, response, err)
+	case len(path) == 2 && path[0] == "variants":
+		if !apiAllows(w, identity, "load:variant") {
+			return
+		}
+
+		variant, err := catalog.Variant(path[1])
+		if err != nil {
+			apiHandlerError(w, err)
+			return
+		}
+
+		apiFile(w, r, variant.CoordinatesFile, func() (interface{}, error) {
+			return underdarkLoadVariant(r.Context(), catalog, []string{path[1]}, "")
+		}, func() ([]byte, error) {
+			return underdarkLoadVariantBinary(r.Context(), catalog, []string{path[1]}, "")
+		})
+	case len(path) == 3 && path[0] == "variants" && path[2] == "stats":
+		if !apiAllows(w, identity, "load:stats") {
+			return
+		}
+
+		response, err := underdarkLoadStats(catalog, []string{path[1]}, "")
+		apiJSON(w, r, response, err)
+	case len(path) == 2 && path[0] == "maps":
+		if !apiAllows(w, identity, "load:map") {
+			return
+		}
+
+		colorMap, err := catalog.ColorMap(path[1])
+		if err != nil {
+			apiHandlerError(w, err)
+			return
+		}
+
+		apiFile(w, r, colorMap.MapFile, func() (interface{}, error) {
+			return underdarkLoadMap(r.Context(), catalog, []string{path[1]}, "")
+		}, func() ([]byte, error) {
+			return underdarkLoadMapBinary(r.Context(), catalog, []string{path[1]}, "")
+		})
+	case len(path) >= 5 && path[0] == "fingerprints" && path[2] == "variants":
+		s.serveApiVariant(w, r, catalog, identity, path[1], path[3], path[4:])
+	default:
+		apiError(w, http.StatusNotFound, underdark.ErrUnknownCommand, "not found")
+	}
+}
+
+// Serves the bins and search endpoints below a fingerprint and variant
+func (s *Server) serveApiVariant(w http.ResponseWriter, r *http.Request, catalog *catalog.Catalog, identity *Identity, fingerprintId string, variantId string, path []string) {
+	// The handlers expect the database id first, it is not used though
+	databaseId := ""
+
+	if _, err := catalog.Fingerprint(fingerprintId); err != nil {
+		apiHandlerError(w, err)
+		return
+	}
+
+	if _, err := catalog.Variant(variantId); err != nil {
+		apiHandlerError(w, err)
+		return
+	}
+
+	if !catalog.Contains(fingerprintId, variantId) {
+		apiError(w, http.StatusBadRequest, underdark.ErrInvalidArgument, "variant "+variantId+" does not belong to fingerprint "+fingerprintId)
+		return
+	}
+
+	switch {
+	case len(path) == 1 && path[0] == "search":
+		if !apiAllows(w, identity, "search:infos") {
+			return
+		}
+
+		release, err := s.acquireSearch(r.Context(), "search:infos")
+
+		if err != nil {
+			apiHandlerError(w, err)
+			return
+		}
+
+		defer release()
+
+		data := append([]string{fingerprintId, variantId}, r.URL.Query()["q"]...)
+		response, err := underdarkSearch(r.Context(), catalog, data, "")
+		apiJSON(w, r, response, err)
+	case len(path) == 2 && path[0] == "bins":
+		if !apiAllows(w, identity, "load:bin") {
+			return
+		}
+
+		for _, bin := range strings.Split(path[1], ",") {
+			if _, err := strconv.ParseUint(bin, 10, 32); err != nil {
+				apiError(w, http.StatusBadRequest, underdark.ErrInvalidArgument, "invalid bin index "+bin)
+				return
+			}
+		}
+
+		data := []string{databaseId, fingerprintId, variantId, path[1]}
+
+		query := r.URL.Query()
+		if query.Get("offset") != "" || query.Get("limit") != "" {
+			for name, kind := range map[string]argumentKind{"offset": argOffset, "limit": argLimit} {
+				if err := validateArgument(catalog, kind, query.Get(name)); err != nil {
+					apiError(w, http.StatusBadRequest, underdark.ErrInvalidArgument, "invalid "+name+" "+query.Get(name))
+					return
+				}
+			}
+
+			data = append(data, query.Get("offset"), query.Get("limit"))
+		}
+
+		response, err := underdarkLoadBin(r.Context(), catalog, data, "")
+		apiJSON(w, r, response, err)
+	case len(path) == 3 && path[0] == "bins" && path[2] == "preview":
+		if !apiAllows(w, identity, "load:binpreview") {
+			return
+		}
+
+		response, err := underdarkLoadBinPreview(catalog, []string{databaseId, fingerprintId, variantId, path[1]}, "")
+		apiJSON(w, r, response, err)
+	default:
+		apiError(w, http.StatusNotFound, underdark.ErrUnknownCommand, "not found")
+	}
+}
+
+// Serves a variant or map file, depending on the Accept header either as the
+// raw file, as typed arrays or as JSON
+func apiFile(w http.ResponseWriter, r *http.Request, path string, asJSON func() (interface{}, error),
+	asBinary func() ([]byte, error)) {
+	switch negotiate(r, "application/json", "text/plain", "application/octet-stream") {
+	case "application/json":
+		response, err := asJSON()
+		apiJSON(w, r, response, err)
+	case "text/plain":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, path)
+	case "application/octet-stream":
+		buf, err := asBinary()
+		if err != nil {
+			apiHandlerError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+
+		if r.Method != http.MethodHead {
+			w.Write(buf)
+		}
+	default:
+		apiError(w, http.StatusNotAcceptable, underdark.ErrInvalidArgument, "not acceptable")
+	}
+}
+
+// Recovers from a panic while handling the request, logs it and writes an
+// internal error response, must be deferred
+func apiRecover(w http.ResponseWriter, r *http.Request) {
+	if v := recover(); v != nil {
+		underdark.Errorf("Panic handling %s: %v\n%s", r.URL.Path, v, debug.Stack())
+		apiError(w, http.StatusInternalServerError, underdark.ErrInternal, "internal error")
+	}
+}
+
+// Writes the response of a handler or, if the handler failed, the error
+func apiJSON(w http.ResponseWriter, r *http.Request, v interface{}, err error) {
+	if err != nil {
+		apiHandlerError(w, err)
+		return
+	}
+
+	if negotiate(r, "application/json") == "" {
+		apiError(w, http.StatusNotAcceptable, underdark.ErrInvalidArgument, "not acceptable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		underdark.Errorf("Error during writing: %v", err)
+	}
+}
+
+// The HTTP status codes of the handler error codes
+var apiStatus = map[string]int{
+	underdark.ErrUnknownCommand:     http.StatusNotFound,
+	underdark.ErrUnknownDatabase:    http.StatusNotFound,
+	underdark.ErrUnknownFingerprint: http.StatusNotFound,
+	underdark.ErrUnknownVariant:     http.StatusNotFound,
+	underdark.ErrUnknownMap:         http.StatusNotFound,
+	underdark.ErrBinOutOfRange:      http.StatusBadRequest,
+	underdark.ErrInvalidArgument:    http.StatusBadRequest,
+	underdark.ErrIO:                 http.StatusInternalServerError,
+	underdark.ErrCancelled:          http.StatusServiceUnavailable,
+	underdark.ErrBusy:               http.StatusServiceUnavailable,
+	underdark.ErrUnauthorized:       http.StatusUnauthorized,
+	underdark.ErrForbidden:          http.StatusForbidden,
+	underdark.ErrRateLimited:        http.StatusTooManyRequests,
+	underdark.ErrInternal:           http.StatusInternalServerError,
+}
+
+func apiHandlerError(w http.ResponseWriter, err error) {
+	underdark.Errorf("Error handling API request: %v", err)
+
+	if e, ok := err.(*underdark.Error); ok {
+		if status, ok := apiStatus[e.Code]; ok {
+			apiError(w, status, e.Code, e.Message)
+			return
+		}
+	}
+
+	apiError(w, http.StatusInternalServerError, underdark.ErrInternal, err.Error())
+}
+
+// Writes a forbidden error if the command is outside the scopes of the
+// identity, returns whether the request may proceed
+func apiAllows(w http.ResponseWriter, identity *Identity, command string) bool {
+	if identity.Allows(command) {
+		return true
+	}
+
+	apiHandlerError(w, forbidden(identity, command))
+
+	return false
+}
+
+// Errors are returned in the same envelope as on the WebSocket
+func apiError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(ErrorResponseMessage{
+		Command: "error",
+		Code:    code,
+		Message: message,
+	})
+}
+
+// A media range of an Accept header (e.g. text/*) and its quality
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+func (m mediaRange) matches(offer string) bool {
+	return m.mediaType == offer || m.mediaType == "*/*" ||
+		(strings.HasSuffix(m.mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(m.mediaType, "*")))
+}
+
+// A type (e.g. text/plain) is more specific than a subtype wildcard (text/*),
+// which is more specific than */*
+func (m mediaRange) specificity() int {
+	switch {
+	case m.mediaType == "*/*":
+		return 0
+	case strings.HasSuffix(m.mediaType, "/*"):
+		return 1
+	}
+
+	return 2
+}
+
+// Returns the offered media type with the highest quality in the Accept
+// header of the request, or an empty string if none is acceptable. The
+// quality of a type is that of the most specific range matching it, a
+// quality of 0 refuses it. Ranges of the same quality are tried in the order
+// of the header, without Accept header the first offered type is returned.
+func negotiate(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+
+	if accept == "" {
+		return offers[0]
+	}
+
+	var ranges []mediaRange
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+
+		if value, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+
+		ranges = append(ranges, mediaRange{mediaType, q})
+	}
+
+	// The quality of each offer
+	quality := map[string]float64{}
+
+	for _, offer := range offers {
+		specificity := -1
+
+		for _, m := range ranges {
+			if m.matches(offer) && m.specificity() > specificity {
+				specificity = m.specificity()
+				quality[offer] = m.q
+			}
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	for _, m := range ranges {
+		if m.q == 0 {
+			break
+		}
+
+		for _, offer := range offers {
+			if m.matches(offer) && quality[offer] == m.q {
+				return offer
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+func TestServeApi(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	s := NewServer(c)
+	s.RateLimit = 0
+
+	tests := []struct {
+		method      string
+		path        string
+		accept      string
+		status      int
+		code        string // the error code, if any
+		contentType string
+	}{
+		// Routing
+		{"GET", "init", "", 200, "", "application/json"},
+		{"GET", "unknown", "", 404, "unknown_command", "application/json"},
+		{"GET", "variants", "", 404, "unknown_command", "application/json"},
+		{"GET", "fingerprints/db.fp/variants/db.fp.v/unknown", "", 404, "unknown_command", "application/json"},
+		{"POST", "init", "", 405, "invalid_argument", "application/json"},
+		{"DELETE", "variants/db.fp.v", "", 405, "invalid_argument", "application/json"},
+
+		// Status of the error codes
+		{"GET", "variants/db.other.v", "", 404, "unknown_variant", "application/json"},
+		{"GET", "variants/private.fp.v", "", 404, "unknown_variant", "application/json"},
+		{"GET", "maps/db.fp.v.other", "", 404, "unknown_map", "application/json"},
+		{"GET", "fingerprints/db.other/variants/db.fp.v/bins/0", "", 404, "unknown_fingerprint", "application/json"},
+		{"GET", "fingerprints/db.fp/variants/private.fp.v/bins/0", "", 404, "unknown_variant", "application/json"},
+		{"GET", "fingerprints/db.fp/variants/db.fp.v/bins/0,a", "", 400, "invalid_argument", "application/json"},
+		{"GET", "fingerprints/db.fp/variants/db.fp.v/bins/5", "", 400, "bin_out_of_range", "application/json"},
+		{"GET", "fingerprints/db.fp/variants/db.fp.v/bins/0?offset=-1", "", 400, "invalid_argument", "application/json"},
+		{"GET", "fingerprints/db.fp/variants/db.fp.v/bins/0?limit=0", "", 400, "invalid_argument", "application/json"},
+		{"GET", "fingerprints/db.fp/variants/db.fp.v/bins/0?offset=1&limit=1", "", 200, "", "application/json"},
+		{"GET", "fingerprints/db.fp/variants/db.fp.v/bins/0/preview", "", 200, "", "application/json"},
+		{"GET", "fingerprints/db.fp/variants/db.fp.v/search?q=CCO", "", 200, "", "application/json"},
+		{"GET", "variants/db.fp.v/stats", "", 200, "", "application/json"},
+
+		// Content negotiation
+		{"GET", "variants/db.fp.v", "application/json", 200, "", "application/json"},
+		{"GET", "variants/db.fp.v", "text/plain", 200, "", "text/plain; charset=utf-8"},
+		{"GET", "variants/db.fp.v", "text/*", 200, "", "text/plain; charset=utf-8"},
+		{"GET", "maps/db.fp.v.m", "application/octet-stream", 200, "", "application/octet-stream"},
+		{"GET", "variants/db.fp.v", "image/png, text/plain", 200, "", "text/plain; charset=utf-8"},
+		{"GET", "variants/db.fp.v", "image/png", 406, "invalid_argument", "application/json"},
+		{"GET", "init", "text/plain", 406, "invalid_argument", "application/json"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, ApiPrefix+test.path, nil)
+
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+
+		w := httptest.NewRecorder()
+		s.ServeApi(w, r)
+
+		if w.Code != test.status || w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%s %s (Accept %q) = %d %s, want %d %s", test.method, test.path, test.accept,
+				w.Code, w.Header().Get("Content-Type"), test.status, test.contentType)
+		}
+
+		if test.code != "" {
+			var e ErrorResponseMessage
+
+			if err := json.NewDecoder(w.Body).Decode(&e); err != nil || e.Code != test.code {
+				t.Errorf("%s %s error = %+v, %v, want %s", test.method, test.path, e, err, test.code)
+			}
+		}
+
+		if test.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s %s Allow = %q, want GET, HEAD", test.method, test.path, w.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestServeApiContent(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	s := NewServer(c)
+	s.RateLimit = 0
+
+	get := func(method string, path string, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, ApiPrefix+path, nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		s.ServeApi(w, r)
+
+		return w
+	}
+
+	// The raw file, typed arrays and JSON
+	if w := get("GET", "variants/db.fp.v", "text/plain"); w.Body.String() != "1,1,1\n2,2,2\n" {
+		t.Errorf("variant as text/plain = %q, want the coordinates file", w.Body.String())
+	}
+
+	w := get("GET", "variants/db.fp.v", "application/octet-stream")
+
+	if body := w.Body.Bytes(); len(body) == 0 || body[0] != binaryVariant || w.Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("variant as application/octet-stream = %v (Content-Length %s), want a binary variant message",
+			body, w.Header().Get("Content-Length"))
+	}
+
+	var variant VariantResponseMessage
+
+	if err := json.NewDecoder(get("GET", "variants/db.fp.v", "").Body).Decode(&variant); err != nil || variant.Command != "load:variant" {
+		t.Errorf("variant as JSON = %+v, %v", variant, err)
+	}
+
+	// HEAD requests have the headers but no body
+	for _, accept := range []string{"application/json", "text/plain", "application/octet-stream"} {
+		w := get("HEAD", "variants/db.fp.v", accept)
+
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), accept) || w.Body.Len() != 0 {
+			t.Errorf("HEAD variant (Accept %s) = %d %s with %d bytes, want 200 and no body",
+				accept, w.Code, w.Header().Get("Content-Type"), w.Body.Len())
+		}
+	}
+}
+
+func TestServeApiSearchCancelled(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	s := NewServer(c)
+	s.RateLimit = 0
+
+	// The request is cancelled while waiting for a search slot
+	for i := 0; i < maxConcurrentSearches; i++ {
+		s.searchSlots <- struct{}{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := httptest.NewRequest("GET", ApiPrefix+"fingerprints/db.fp/variants/db.fp.v/search?q=CCO", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	s.ServeApi(w, r)
+
+	var e ErrorResponseMessage
+
+	if err := json.NewDecoder(w.Body).Decode(&e); w.Code != http.StatusServiceUnavailable || err != nil || e.Code != underdark.ErrCancelled {
+		t.Errorf("search waiting for a slot = %d %+v, %v, want 503 %s", w.Code, e, err, underdark.ErrCancelled)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"application/json", "text/plain", "application/octet-stream"}
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"text/plain", "text/plain"},
+		{"text/*", "text/plain"},
+		{"application/*", "application/json"},
+		{"application/octet-stream, application/json", "application/octet-stream"},
+		{"text/plain;q=0, application/octet-stream", "application/octet-stream"},
+		{"text/plain;q=0.5, application/octet-stream;q=0.8", "application/octet-stream"},
+		{"application/json;q=0.1, text/*", "text/plain"},
+		{"*/*;q=0.9, application/json;q=0.1", "text/plain"},
+		{"application/json;q=0.0, */*", "text/plain"},
+		{"text/plain;q=0.000", ""},
+		{"text/plain;q=high, application/json;q=2", ""},
+		{"text/html, image/*", ""},
+		{"invalid;;", ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", test.accept)
+
+		if got := negotiate(r, offers...); got != test.want {
+			t.Errorf("negotiate(%q) = %q, want %q", test.accept, got, test.want)
+		}
+	}
+}
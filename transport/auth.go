@@ -0,0 +1,263 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// The caller a token was issued to and the commands it may use
+type Identity struct {
+	Name string `json:"name"`
+
+	// Commands (e.g. "load:bin") or command groups (e.g. "load", "search")
+	// the token may be used for, all commands if empty. The commands init,
+	// cancel, subscribe and unsubscribe are always allowed.
+	Scopes []string `json:"scopes"`
+
+	// The roles of the caller, a database restricted to any of the roles
+	// (or the name) is visible to the caller, see catalog.Database.Allows
+	Roles []string `json:"roles"`
+
+	// The time the token expires, the connection is closed when it expires
+	Expires time.Time `json:"-"`
+}
+
+// Validates a token and returns the identity it was issued to, returns an
+// error if the token is unknown, invalid or expired
+type Authenticator interface {
+	Authenticate(token string) (*Identity, error)
+}
+
+var errUnknownToken = errors.New("unknown token")
+
+// The commands available with any token
+var unscopedCommands = map[string]bool{
+	"init":        true,
+	"cancel":      true,
+	"subscribe":   true,
+	"unsubscribe": true,
+}
+
+// Returns whether the identity may use the command, a nil identity (when
+// authentication is disabled) may use all commands
+func (i *Identity) Allows(command string) bool {
+	if i == nil || len(i.Scopes) == 0 || unscopedCommands[command] {
+		return true
+	}
+
+	group := strings.SplitN(command, ":", 2)[0]
+
+	for _, scope := range i.Scopes {
+		if scope == "*" || scope == command || scope == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the catalog restricted to the databases the identity may access,
+// without identity (when authentication is disabled) only the databases
+// without access restrictions are visible
+func restrict(c *catalog.Catalog, identity *Identity) *catalog.Catalog {
+	if identity == nil {
+		return c.Restrict(nil)
+	}
+
+	return c.Restrict(append([]string{identity.Name}, identity.Roles...))
+}
+
+// Returns the error for a command outside the scopes of the identity
+func forbidden(identity *Identity, command string) *underdark.Error {
+	return &underdark.Error{
+		Code:    underdark.ErrForbidden,
+		Message: "the token of " + identity.Name + " does not allow " + command,
+	}
+}
+
+// Authenticates the request with the token passed as bearer token in the
+// Authorization header, in the X-API-Key header or, since browsers cannot set
+// headers on WebSocket connections, as token query parameter. Returns a nil
+// identity if authentication is disabled.
+func (s *Server) authenticate(r *http.Request) (*Identity, error) {
+	if len(s.Authenticators) == 0 {
+		return nil, nil
+	}
+
+	token := r.URL.Query().Get("token")
+
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		token = key
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	if token == "" {
+		return nil, underdark.NewError(underdark.ErrUnauthorized, "a token is required")
+	}
+
+	for _, authenticator := range s.Authenticators {
+		identity, err := authenticator.Authenticate(token)
+
+		if err == errUnknownToken {
+			continue
+		}
+
+		if err != nil {
+			return nil, underdark.NewError(underdark.ErrUnauthorized, "invalid token: %v", err)
+		}
+
+		return identity, nil
+	}
+
+	return nil, underdark.NewError(underdark.ErrUnauthorized, "invalid token: %v", errUnknownToken)
+}
+
+// Authenticates the request and writes an error response if it fails,
+// returns whether the request may proceed
+func (s *Server) authenticateHTTP(w http.ResponseWriter, r *http.Request) (*Identity, bool) {
+	identity, err := s.authenticate(r)
+
+	if err != nil {
+		underdark.Errorf("Error authenticating %s: %v", r.RemoteAddr, err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		apiError(w, http.StatusUnauthorized, underdark.ErrUnauthorized, err.(*underdark.Error).Message)
+		return nil, false
+	}
+
+	return identity, true
+}
+
+// Static tokens (API keys) read from a file
+type StaticTokens struct {
+	// The identities by the SHA-256 hash of their token, so looking up a
+	// token takes the same time whether it is known or not
+	identities map[[sha256.Size]byte]*Identity
+}
+
+// Reads a JSON file with a list of tokens, e.g.
+//
+//	[{"token": "...", "name": "lab", "scopes": ["load"], "roles": ["internal"]}]
+func LoadTokenFile(path string) (*StaticTokens, error) {
+	buf, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []struct {
+		Identity
+		Token string `json:"token"`
+	}
+
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return nil, errors.New("error parsing " + path + ": " + err.Error())
+	}
+
+	tokens := &StaticTokens{identities: map[[sha256.Size]byte]*Identity{}}
+
+	for i := range entries {
+		if entries[i].Token == "" {
+			return nil, errors.New("error parsing " + path + ": empty token for " + entries[i].Name)
+		}
+
+		identity := entries[i].Identity
+		tokens.identities[sha256.Sum256([]byte(entries[i].Token))] = &identity
+	}
+
+	return tokens, nil
+}
+
+func (t *StaticTokens) Authenticate(token string) (*Identity, error) {
+	if identity, ok := t.identities[sha256.Sum256([]byte(token))]; ok {
+		return identity, nil
+	}
+
+	return nil, errUnknownToken
+}
+
+// Short-lived tokens signed with a shared secret, typically issued by the
+// application that embeds the client. A token is the base64url encoded
+// (without padding) JSON payload
+//
+//	{"sub": "lab", "exp": 1700000000, "scopes": ["load"], "roles": ["internal"]}
+//
+// followed by a dot and the base64url encoded HMAC-SHA256 of the encoded
+// payload. The expiry time (in Unix seconds) is required.
+type SignedTokens struct {
+	Secret []byte
+}
+
+type signedTokenPayload struct {
+	Subject string   `json:"sub"`
+	Expires int64    `json:"exp"`
+	Scopes  []string `json:"scopes,omitempty"`
+	Roles   []string `json:"roles,omitempty"`
+}
+
+// Returns a token for the identity that expires after ttl
+func (t *SignedTokens) Sign(identity Identity, ttl time.Duration) string {
+	payload, _ := json.Marshal(signedTokenPayload{
+		Subject: identity.Name,
+		Expires: time.Now().Add(ttl).Unix(),
+		Scopes:  identity.Scopes,
+		Roles:   identity.Roles,
+	})
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(t.signature(encoded))
+}
+
+func (t *SignedTokens) Authenticate(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 2 {
+		return nil, errUnknownToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil || !hmac.Equal(signature, t.signature(parts[0])) {
+		return nil, errUnknownToken
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	var payload signedTokenPayload
+
+	if err := json.Unmarshal(buf, &payload); err != nil {
+		return nil, err
+	}
+
+	expires := time.Unix(payload.Expires, 0)
+
+	if payload.Expires == 0 || time.Now().After(expires) {
+		return nil, errors.New("token expired")
+	}
+
+	return &Identity{Name: payload.Subject, Scopes: payload.Scopes, Roles: payload.Roles, Expires: expires}, nil
+}
+
+func (t *SignedTokens) signature(payload string) []byte {
+	mac := hmac.New(sha256.New, t.Secret)
+	mac.Write([]byte(payload))
+
+	return mac.Sum(nil)
+}
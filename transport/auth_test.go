@@ -0,0 +1,261 @@
+package transport
+
+import (
+	"encoding/base64"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+func TestSignedTokens(t *testing.T) {
+	tokens := &SignedTokens{Secret: []byte("secret")}
+	identity := Identity{Name: "lab", Scopes: []string{"load"}, Roles: []string{"internal"}}
+
+	got, err := tokens.Authenticate(tokens.Sign(identity, time.Hour))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Name != identity.Name || !reflect.DeepEqual(got.Scopes, identity.Scopes) || !reflect.DeepEqual(got.Roles, identity.Roles) {
+		t.Errorf("Authenticate() = %+v, want %+v", got, identity)
+	}
+
+	if d := time.Until(got.Expires); d <= 0 || d > time.Hour {
+		t.Errorf("Authenticate() expires in %v, want at most %v", d, time.Hour)
+	}
+}
+
+func TestSignedTokensInvalid(t *testing.T) {
+	tokens := &SignedTokens{Secret: []byte("secret")}
+	identity := Identity{Name: "lab", Scopes: []string{"load"}}
+	token := tokens.Sign(identity, time.Hour)
+	parts := strings.Split(token, ".")
+
+	// A payload granting all commands, signed with the wrong secret
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"lab","exp":9999999999}`))
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	signature[0] ^= 1
+
+	tests := []struct {
+		name   string
+		tokens *SignedTokens
+		token  string
+	}{
+		{"expired", tokens, tokens.Sign(identity, -time.Second)},
+		{"tampered payload", tokens, tampered + "." + parts[1]},
+		{"tampered signature", tokens, parts[0] + "." + base64.RawURLEncoding.EncodeToString(signature)},
+		{"wrong secret", &SignedTokens{Secret: []byte("other")}, token},
+		{"no signature", tokens, parts[0]},
+		{"empty", tokens, ""},
+	}
+
+	for _, test := range tests {
+		if got, err := test.tokens.Authenticate(test.token); err == nil {
+			t.Errorf("Authenticate(%s) = %+v, want an error", test.name, got)
+		}
+	}
+}
+
+func TestIdentityAllows(t *testing.T) {
+	tests := []struct {
+		identity *Identity
+		command  string
+		want     bool
+	}{
+		{nil, "search:infos", true},
+		{&Identity{}, "search:infos", true},
+		{&Identity{Scopes: []string{"load"}}, "load:bin", true},
+		{&Identity{Scopes: []string{"load"}}, "search:infos", false},
+		{&Identity{Scopes: []string{"load:bin"}}, "load:bin", true},
+		{&Identity{Scopes: []string{"load:bin"}}, "load:map", false},
+		{&Identity{Scopes: []string{"*"}}, "locate:compounds", true},
+		{&Identity{Scopes: []string{"load"}}, "init", true},
+		{&Identity{Scopes: []string{"load"}}, "cancel", true},
+		{&Identity{Scopes: []string{"load"}}, "subscribe", true},
+	}
+
+	for _, test := range tests {
+		if got := test.identity.Allows(test.command); got != test.want {
+			t.Errorf("%+v.Allows(%q) = %v, want %v", test.identity, test.command, got, test.want)
+		}
+	}
+
+	// The scopes of a signed token are enforced
+	tokens := &SignedTokens{Secret: []byte("secret")}
+	identity, err := tokens.Authenticate(tokens.Sign(Identity{Name: "lab", Scopes: []string{"search"}}, time.Hour))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.Allows("load:bin") || !identity.Allows("search:similar") {
+		t.Errorf("signed token with scope search allows %v", identity.Scopes)
+	}
+}
+
+// Returns the ids of the databases in the configuration
+func databaseIds(config catalog.Configuration) []string {
+	ids := []string{}
+
+	for _, database := range config.Databases {
+		ids = append(ids, database.Id)
+	}
+
+	return ids
+}
+
+func TestRestrict(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		identity *Identity
+		want     []string
+	}{
+		{nil, []string{"db"}},
+		{&Identity{Name: "lab"}, []string{"db"}},
+		{&Identity{Name: "admin"}, []string{"db", "private"}},
+		{&Identity{Name: "lab", Roles: []string{"internal"}}, []string{"db", "private"}},
+		{&Identity{Name: "lab", Roles: []string{"external"}}, []string{"db"}},
+	}
+
+	for _, test := range tests {
+		view := restrict(c, test.identity)
+
+		if got := databaseIds(view.Config()); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("restrict(%+v) has databases %v, want %v", test.identity, got, test.want)
+		}
+
+		// Who may access a database is not revealed
+		for _, database := range view.Config().Databases {
+			if database.Access != nil {
+				t.Errorf("restrict(%+v) reveals the access list of %s", test.identity, database.Id)
+			}
+		}
+	}
+}
+
+func TestRestrictLookups(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	lookups := []struct {
+		code   string
+		lookup func(*catalog.Catalog, string) error
+	}{
+		{underdark.ErrUnknownDatabase, func(c *catalog.Catalog, id string) error {
+			_, err := c.Database(id)
+			return err
+		}},
+		{underdark.ErrUnknownFingerprint, func(c *catalog.Catalog, id string) error {
+			_, err := c.Fingerprint(id + ".fp")
+			return err
+		}},
+		{underdark.ErrUnknownVariant, func(c *catalog.Catalog, id string) error {
+			_, err := c.Variant(id + ".fp.v")
+			return err
+		}},
+		{underdark.ErrUnknownMap, func(c *catalog.Catalog, id string) error {
+			_, err := c.ColorMap(id + ".fp.v.m")
+			return err
+		}},
+	}
+
+	public := restrict(c, nil)
+	admin := restrict(c, &Identity{Name: "admin"})
+
+	for _, l := range lookups {
+		if err := l.lookup(public, "private"); !hasCode(err, l.code) {
+			t.Errorf("lookup in a restricted database error = %v, want %s", err, l.code)
+		}
+
+		if err := l.lookup(public, "db"); err != nil {
+			t.Errorf("lookup in a public database error = %v", err)
+		}
+
+		if err := l.lookup(admin, "private"); err != nil {
+			t.Errorf("lookup in a database the token may access error = %v", err)
+		}
+	}
+
+	// The restricted ids are rejected like unknown ones
+	if err := validate(public, "load:bin", []string{"private", "private.fp", "private.fp.v", "0"}); !hasCode(err, underdark.ErrUnknownDatabase) {
+		t.Errorf("validate() of a restricted database error = %v, want %s", err, underdark.ErrUnknownDatabase)
+	}
+}
+
+func TestReloadRestricted(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	s := NewServer(c)
+
+	newClient := func(identity *Identity) *Client {
+		client := &Client{
+			server:   s,
+			out:      make(chan outgoing, 8),
+			done:     make(chan struct{}),
+			catalog:  restrict(c, identity),
+			identity: identity,
+		}
+
+		if _, err := client.underdarkSubscribe([]string{"config"}, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		return client
+	}
+
+	public := newClient(nil)
+	admin := newClient(&Identity{Name: "admin"})
+
+	defer public.underdarkUnsubscribe(nil, "")
+	defer admin.underdarkUnsubscribe(nil, "")
+
+	s.Reload(c, []string{"db.fp.v", "private.fp.v"})
+
+	tests := []struct {
+		client    *Client
+		databases []string
+		variants  []string
+	}{
+		{public, []string{"db"}, []string{"db.fp.v"}},
+		{admin, []string{"db", "private"}, []string{"db.fp.v", "private.fp.v"}},
+	}
+
+	for _, test := range tests {
+		changed := (<-test.client.out).message.(ConfigChangedMessage)
+
+		if got := databaseIds(changed.Content); !reflect.DeepEqual(got, test.databases) {
+			t.Errorf("config:changed of %+v has databases %v, want %v", test.client.identity, got, test.databases)
+		}
+
+		for _, want := range test.variants {
+			if got := (<-test.client.out).message.(VariantReloadedMessage); got.Id != want {
+				t.Errorf("variant:reloaded of %+v = %s, want %s", test.client.identity, got.Id, want)
+			}
+		}
+
+		// The client is served from its view of the new catalog
+		if got := databaseIds(test.client.catalog.Config()); !reflect.DeepEqual(got, test.databases) {
+			t.Errorf("catalog of %+v has databases %v, want %v", test.client.identity, got, test.databases)
+		}
+
+		select {
+		case response := <-test.client.out:
+			t.Errorf("%+v received %+v, want no more messages", test.client.identity, response.message)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func hasCode(err error, code string) bool {
+	e, ok := err.(*underdark.Error)
+	return ok && e.Code == code
+}
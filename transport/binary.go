@@ -0,0 +1,278 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// Large files are requested in chunked transfer mode by passing "chunked"
+// after the id
+func isChunked(data []string) bool {
+	return len(data) > 1 && data[1] == "chunked"
+}
+
+// Sends a file as a header frame (<cmd>:header) containing the total size and
+// the SHA-256 checksum, followed by numbered frames (<cmd>:chunk) of at most
+// chunkSize bytes, so only one chunk is kept in memory at a time
+func sendChunked(ctx context.Context, command string, id string, requestId string, path string, send func(interface{}) error) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return underdark.NewError(underdark.ErrIO, "error loading %s: %v", id, err)
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+
+	if err != nil {
+		return underdark.NewError(underdark.ErrIO, "error loading %s: %v", id, err)
+	}
+
+	err = send(ChunkHeaderMessage{
+		Command:   command + ":header",
+		Id:        id,
+		Size:      size,
+		Chunks:    (size + chunkSize - 1) / chunkSize,
+		ChunkSize: chunkSize,
+		Checksum:  hex.EncodeToString(hash.Sum(nil)),
+		RequestId: requestId,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, chunkSize)
+	var i int64
+
+	for offset := int64(0); offset < size; offset += chunkSize {
+		if ctx.Err() != nil {
+			return underdark.Cancelled(ctx)
+		}
+
+		n, err := file.ReadAt(buf, offset)
+
+		if err != nil && err != io.EOF {
+			return underdark.NewError(underdark.ErrIO, "error loading %s: %v", id, err)
+		}
+
+		err = send(ChunkMessage{
+			Command:   command + ":chunk",
+			Id:        id,
+			Index:     i,
+			Content:   string(buf[:n]),
+			RequestId: requestId,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		underdark.ReportProgress(ctx, "sending", offset+int64(n), size)
+
+		i++
+	}
+
+	return nil
+}
+
+// Coordinates and maps are requested as binary messages by passing "binary"
+// after the id
+func isBinary(data []string) bool {
+	return len(data) > 1 && data[1] == "binary"
+}
+
+// The kinds of binary messages
+const (
+	binaryVariant = 1
+	binaryMap     = 2
+)
+
+// The codes, sizes and ranges of the data types in binary messages
+var binaryDataTypes = map[string]struct {
+	code     byte
+	size     int
+	min, max float64
+}{
+	"int8":    {1, 1, math.MinInt8, math.MaxInt8},
+	"uint8":   {2, 1, 0, math.MaxUint8},
+	"int16":   {3, 2, math.MinInt16, math.MaxInt16},
+	"uint16":  {4, 2, 0, math.MaxUint16},
+	"int32":   {5, 4, math.MinInt32, math.MaxInt32},
+	"uint32":  {6, 4, 0, math.MaxUint32},
+	"float32": {7, 4, -math.MaxFloat32, math.MaxFloat32},
+	"float64": {8, 8, -math.MaxFloat64, math.MaxFloat64},
+}
+
+// Encodes a file containing one row of values per line as a binary message
+// with one little-endian typed array per column. The header consists of
+//
+//	uint8   kind (1 = variant, 2 = map)
+//	uint8   length of the id, followed by the id
+//	uint8   length of the request id, followed by the request id
+//	uint8   number of columns, followed by one data type code per column
+//	uint32  number of rows
+//
+// and is padded to a multiple of 8 bytes, as is each column, so that the
+// client can create typed arrays directly on the buffer. The file is read
+// line by line into one buffer per column (progress is reported in bytes
+// read), values that do not fit the data type of their column, short rows and
+// blank lines are rejected rather than wrapped around or padded with zeros.
+func encodeBinary(ctx context.Context, kind byte, id string, requestId string, path string, dataTypes []string) ([]byte, error) {
+	if len(requestId) > 255 {
+		return nil, underdark.NewError(underdark.ErrInvalidArgument, "request id longer than 255 bytes")
+	}
+
+	if len(id) > 255 || len(dataTypes) > 255 {
+		return nil, underdark.NewError(underdark.ErrInternal, "id or data types of %s too long", id)
+	}
+
+	for _, dataType := range dataTypes {
+		if _, ok := binaryDataTypes[dataType]; !ok {
+			return nil, underdark.NewError(underdark.ErrInternal, "unknown data type %s", dataType)
+		}
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, underdark.NewError(underdark.ErrIO, "error opening %s: %v", path, err)
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return nil, underdark.NewError(underdark.ErrIO, "error opening %s: %v", path, err)
+	}
+
+	// The bytes read so far, progress is reported in bytes of the file
+	size := info.Size()
+	var read int64
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+
+	const maxCapacity = 1024 * 1024
+	scanBuf := make([]byte, maxCapacity)
+	scanner.Buffer(scanBuf, maxCapacity)
+
+	columns := make([]bytes.Buffer, len(dataTypes))
+	var rows uint32
+
+	for ; scanner.Scan(); rows++ {
+		if rows%underdark.CancelCheckInterval == 0 {
+			if ctx.Err() != nil {
+				return nil, underdark.Cancelled(ctx)
+			}
+
+			underdark.ReportProgress(ctx, "reading", read, size)
+		}
+
+		read += int64(len(scanner.Bytes())) + 1
+
+		row := strings.FieldsFunc(scanner.Text(), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+
+		if len(row) < len(dataTypes) {
+			return nil, underdark.NewError(underdark.ErrIO, "line %d of %s has %d values, want %d", rows, path, len(row), len(dataTypes))
+		}
+
+		for j, dataType := range dataTypes {
+			value, err := strconv.ParseFloat(row[j], 64)
+
+			if err != nil {
+				return nil, underdark.NewError(underdark.ErrIO, "invalid value on line %d of %s: %v", rows, path, err)
+			}
+
+			if err := writeBinaryValue(&columns[j], dataType, value); err != nil {
+				return nil, underdark.NewError(underdark.ErrIO, "invalid value on line %d of %s: %v", rows, path, err)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, underdark.NewError(underdark.ErrIO, "error reading %s: %v", path, err)
+	}
+
+	underdark.ReportProgress(ctx, "reading", size, size)
+
+	var buf bytes.Buffer
+
+	buf.WriteByte(kind)
+	buf.WriteByte(byte(len(id)))
+	buf.WriteString(id)
+	buf.WriteByte(byte(len(requestId)))
+	buf.WriteString(requestId)
+	buf.WriteByte(byte(len(dataTypes)))
+
+	for _, dataType := range dataTypes {
+		buf.WriteByte(binaryDataTypes[dataType].code)
+	}
+
+	binary.Write(&buf, binary.LittleEndian, rows)
+	padBinary(&buf)
+
+	for j := range columns {
+		buf.Write(columns[j].Bytes())
+		padBinary(&buf)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Appends a value to a column, the value has to be in the range of the data
+// type of the column (NaN and infinity are only allowed for floats)
+func writeBinaryValue(buf *bytes.Buffer, dataType string, value float64) error {
+	t := binaryDataTypes[dataType]
+	isFloat := dataType == "float32" || dataType == "float64"
+
+	if !(value >= t.min && value <= t.max) && !(isFloat && (math.IsNaN(value) || math.IsInf(value, 0))) {
+		return fmt.Errorf("%v out of range for %s", value, dataType)
+	}
+
+	var v interface{}
+
+	switch dataType {
+	case "int8":
+		v = int8(value)
+	case "uint8":
+		v = uint8(value)
+	case "int16":
+		v = int16(value)
+	case "uint16":
+		v = uint16(value)
+	case "int32":
+		v = int32(value)
+	case "uint32":
+		v = uint32(value)
+	case "float32":
+		v = float32(value)
+	case "float64":
+		v = value
+	}
+
+	return binary.Write(buf, binary.LittleEndian, v)
+}
+
+func padBinary(buf *bytes.Buffer) {
+	for buf.Len()%8 != 0 {
+		buf.WriteByte(0)
+	}
+}
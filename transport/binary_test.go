@@ -0,0 +1,198 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+func TestEncodeBinary(t *testing.T) {
+	path := writeTempFile(t, "1,2,0.5\n3 4 -1.5 7\n")
+	defer os.Remove(path)
+
+	got, err := encodeBinary(context.Background(), binaryMap, "m", "r", path, []string{"uint8", "int16", "float32"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{
+		binaryMap, 1, 'm', 1, 'r', 3, 2, 3, 7, 2, 0, 0, 0, 0, 0, 0, // header, 2 rows
+		1, 3, 0, 0, 0, 0, 0, 0, // uint8
+		2, 0, 4, 0, 0, 0, 0, 0, // int16
+		0, 0, 0, 0x3f, 0, 0, 0xc0, 0xbf, // float32
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("encodeBinary() = %v, want %v", got, want)
+	}
+}
+
+func TestEncodeBinaryInvalid(t *testing.T) {
+	tests := []struct {
+		content  string
+		dataType string
+	}{
+		{"256\n", "uint8"},
+		{"-1\n", "uint16"},
+		{"-129\n", "int8"},
+		{"65536\n", "uint16"},
+		{"4294967296\n", "uint32"},
+		{"1e39\n", "float32"},
+		{"NaN\n", "int32"},
+		{"a\n", "float64"},
+		{"1\n\n2\n", "uint8"},
+		{"\n", "uint8"},
+		{"1,2\n3\n", "uint8,uint8"},
+	}
+
+	for _, test := range tests {
+		path := writeTempFile(t, test.content)
+		_, err := encodeBinary(context.Background(), binaryVariant, "v", "", path, strings.Split(test.dataType, ","))
+		os.Remove(path)
+
+		if e, ok := err.(*underdark.Error); !ok || e.Code != underdark.ErrIO {
+			t.Errorf("encodeBinary(%q, %s) error = %v, want %s", test.content, test.dataType, err, underdark.ErrIO)
+		}
+	}
+}
+
+func TestEncodeBinaryRequestId(t *testing.T) {
+	path := writeTempFile(t, "1\n")
+	defer os.Remove(path)
+
+	_, err := encodeBinary(context.Background(), binaryVariant, "v", strings.Repeat("r", 256), path, []string{"uint8"})
+
+	if e, ok := err.(*underdark.Error); !ok || e.Code != underdark.ErrInvalidArgument {
+		t.Errorf("encodeBinary() with a request id of 256 bytes error = %v, want %s", err, underdark.ErrInvalidArgument)
+	}
+}
+
+func TestEncodeBinaryProgress(t *testing.T) {
+	path := writeTempFile(t, strings.Repeat("1\n", 2500))
+	defer os.Remove(path)
+
+	var reported [][2]int64
+
+	ctx := underdark.WithProgress(context.Background(), func(phase string, processed int64, total int64) {
+		reported = append(reported, [2]int64{processed, total})
+	})
+
+	if _, err := encodeBinary(ctx, binaryVariant, "v", "", path, []string{"uint8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every underdark.CancelCheckInterval lines and once done
+	want := [][2]int64{{0, 5000}, {2000, 5000}, {4000, 5000}, {5000, 5000}}
+
+	if !reflect.DeepEqual(reported, want) {
+		t.Errorf("encodeBinary() reported %v, want %v", reported, want)
+	}
+}
+
+func TestSendChunked(t *testing.T) {
+	tests := []struct {
+		size   int
+		chunks int64
+	}{
+		{0, 0},
+		{1, 1},
+		{chunkSize, 1},
+		{chunkSize*2 + chunkSize/2, 3},
+	}
+
+	for _, test := range tests {
+		content := strings.Repeat("0123456789", test.size/10+1)[:test.size]
+		path := writeTempFile(t, content)
+
+		var header ChunkHeaderMessage
+		var chunks []ChunkMessage
+
+		err := sendChunked(context.Background(), "load:variant", "v", "r", path, func(v interface{}) error {
+			switch m := v.(type) {
+			case ChunkHeaderMessage:
+				header = m
+			case ChunkMessage:
+				chunks = append(chunks, m)
+			}
+
+			return nil
+		})
+		os.Remove(path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checksum := sha256.Sum256([]byte(content))
+
+		if header.Command != "load:variant:header" || header.Size != int64(test.size) || header.Chunks != test.chunks ||
+			header.ChunkSize != chunkSize || header.Checksum != hex.EncodeToString(checksum[:]) || header.RequestId != "r" {
+			t.Errorf("header of %d bytes = %+v, want %d chunks", test.size, header, test.chunks)
+		}
+
+		if int64(len(chunks)) != test.chunks {
+			t.Errorf("%d bytes sent in %d chunks, want %d", test.size, len(chunks), test.chunks)
+			continue
+		}
+
+		var sent strings.Builder
+
+		for i, chunk := range chunks {
+			if chunk.Command != "load:variant:chunk" || chunk.Index != int64(i) || chunk.RequestId != "r" {
+				t.Errorf("chunk %d of %d bytes = %s %d (request id %s)", i, test.size, chunk.Command, chunk.Index, chunk.RequestId)
+			}
+
+			sent.WriteString(chunk.Content)
+		}
+
+		if sent.String() != content {
+			t.Errorf("chunks of %d bytes do not add up to the file", test.size)
+		}
+	}
+}
+
+func TestSendChunkedCancelled(t *testing.T) {
+	path := writeTempFile(t, strings.Repeat("0", chunkSize*3))
+	defer os.Remove(path)
+
+	// The request is cancelled after the first chunk has been sent
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chunks := 0
+
+	err := sendChunked(ctx, "load:variant", "v", "", path, func(v interface{}) error {
+		if _, ok := v.(ChunkMessage); ok {
+			chunks++
+			cancel()
+		}
+
+		return nil
+	})
+
+	if !hasCode(err, underdark.ErrCancelled) || chunks != 1 {
+		t.Errorf("sendChunked() cancelled after the first chunk = %d chunks, %v, want 1, %s", chunks, err, underdark.ErrCancelled)
+	}
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "underdark")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString(content)
+	f.Close()
+
+	return f.Name()
+}
@@ -0,0 +1,665 @@
+// Package transport serves a catalog over WebSocket (Server.ServeUnderdark)
+// and as a REST API (Server.ServeApi).
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// The minimum time between two progress messages of a request
+const progressInterval = 500 * time.Millisecond
+
+// The number of requests handled at the same time per connection and over
+// all connections, and the number of requests a connection can queue
+const workersPerClient = 4
+const maxConcurrentRequests = 64
+const requestQueueSize = 256
+
+// The largest message read from a client, larger messages close the
+// connection. The largest valid requests, maxBinsPerRequest bin indices or
+// maxTermsPerRequest search terms of about a thousand characters, fit.
+const maxMessageSize = 1024 * 1024
+
+const writeWait = 100 * time.Second
+const pongWait = 120 * time.Second
+const pingPeriod = (pongWait * 9) / 10
+
+type Client struct {
+	server *Server
+	conn   *websocket.Conn
+	send   chan RequestMessage
+	out    chan outgoing
+	done   chan struct{}
+
+	// Cancelled when the connection is closed, the requests in progress can
+	// be cancelled by request id
+	ctx     context.Context
+	stop    context.CancelFunc
+	mutex   sync.Mutex
+	cancels map[string]context.CancelFunc
+
+	// The catalog the requests are served from, restricted to the databases
+	// the client may access. Replaced on reload only if the client is
+	// subscribed to "config".
+	catalog *catalog.Catalog
+
+	// The caller the connection was authenticated as, nil if authentication
+	// is disabled
+	identity *Identity
+
+	// Limits the requests of the connection, and the number of searches in
+	// progress, see acquireSearch. Control commands have their own limiter,
+	// so they get through while the requests use up the other one.
+	limiter        *rateLimiter
+	controlLimiter *rateLimiter
+	searches       int
+
+	// The notifications of reloads waiting to be queued and whether a
+	// goroutine is queueing them, see notify
+	notifications []interface{}
+	notifying     bool
+}
+
+// A response (a message or the bytes of a binary message) and the command
+// it is sent for
+type outgoing struct {
+	command string
+	message interface{}
+}
+
+var errConnectionClosed = errors.New("connection closed")
+
+// The topics clients can subscribe to, see Server.Reload
+var topics = map[string]bool{"config": true}
+
+// The commands handled as soon as they are read, they only act on the
+// connection itself and have to get through while the queue is full or the
+// requests in progress hold all slots
+var controlCommands = map[string]bool{
+	"cancel":      true,
+	"subscribe":   true,
+	"unsubscribe": true,
+}
+
+// Authenticates the request (see authenticate) and upgrades it to a
+// WebSocket connection
+func (s *Server) ServeUnderdark(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authenticateHTTP(w, r)
+
+	if !ok {
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		underdark.Errorf("Error while upgrading connection: %v", err)
+		return
+	}
+
+	// The connection is closed when a short-lived token expires
+	var ctx context.Context
+	var stop context.CancelFunc
+
+	if identity != nil && !identity.Expires.IsZero() {
+		ctx, stop = context.WithDeadline(context.Background(), identity.Expires)
+	} else {
+		ctx, stop = context.WithCancel(context.Background())
+	}
+
+	client := &Client{
+		server:         s,
+		conn:           conn,
+		send:           make(chan RequestMessage, requestQueueSize),
+		out:            make(chan outgoing),
+		done:           make(chan struct{}),
+		ctx:            ctx,
+		stop:           stop,
+		cancels:        map[string]context.CancelFunc{},
+		catalog:        restrict(s.currentCatalog(), identity),
+		identity:       identity,
+		limiter:        newRateLimiter(s.RateLimit),
+		controlLimiter: newRateLimiter(s.RateLimit),
+	}
+	for i := 0; i < workersPerClient; i++ {
+		go client.work()
+	}
+
+	atomic.AddInt64(&activeConnections, 1)
+	defer atomic.AddInt64(&activeConnections, -1)
+
+	go client.write()
+	client.read()
+}
+
+// Reads the requests and queues them for the workers, if the queue is full
+// the request is rejected with a busy error and if the rate limit of the
+// connection or its token is exceeded with a rate limited error. Control
+// commands are handled right away, without a worker or a request slot, and
+// are rate limited separately. A message larger than maxMessageSize closes
+// the connection.
+func (c *Client) read() {
+	defer func() {
+		close(c.send)
+		c.stop()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, buf, err := c.conn.ReadMessage()
+
+		if err != nil {
+			if err == websocket.ErrReadLimit {
+				underdark.Errorf("Error during reading: message larger than %d bytes", maxMessageSize)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
+				underdark.Errorf("Error during reading: %v", err)
+			}
+			break
+		}
+
+		// A malformed message is answered with an error, the connection is
+		// kept open
+		msg := RequestMessage{}
+
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			c.queue(msg.Command, errorResponse(msg, &underdark.Error{
+				Code:    underdark.ErrInvalidArgument,
+				Message: "invalid message: " + err.Error(),
+			}))
+			continue
+		}
+
+		if controlCommands[msg.Command] {
+			if ok, wait := takeAll(c.controlLimiter); !ok {
+				c.queue(msg.Command, errorResponse(msg, rateLimited(wait)))
+			} else {
+				c.handle(msg)
+			}
+
+			continue
+		}
+
+		if ok, wait := takeAll(c.limiter, c.server.tokenLimiter(c.identity)); !ok {
+			c.queue(msg.Command, errorResponse(msg, rateLimited(wait)))
+			continue
+		}
+
+		select {
+		case c.send <- msg:
+		default:
+			c.queue(msg.Command, errorResponse(msg, &underdark.Error{
+				Code:    underdark.ErrBusy,
+				Message: "too many requests in progress, try again later",
+			}))
+		}
+	}
+}
+
+// Handles the queued requests one by one, a connection has
+// workersPerClient workers and at most maxConcurrentRequests requests are
+// handled at the same time over all connections
+func (c *Client) work() {
+	for message := range c.send {
+		select {
+		case c.server.requestSlots <- struct{}{}:
+		case <-c.ctx.Done():
+			return
+		}
+
+		c.handle(message)
+
+		<-c.server.requestSlots
+	}
+}
+
+// Runs the handler of a command and queues the response, errors returned
+// by the handler are sent as error responses. All responses echo the
+// request id of the request.
+func (c *Client) handle(message RequestMessage) {
+	var response interface{}
+	var err error
+
+	// The error code of the response, recorded in the metrics
+	start := time.Now()
+	code := "ok"
+
+	send := func(v interface{}) error {
+		if e, ok := v.(ErrorResponseMessage); ok {
+			code = e.Code
+		}
+
+		return c.queue(message.Command, v)
+	}
+
+	defer func() {
+		observeRequest(message.Command, code, start)
+	}()
+
+	// A bad request must not take down the connection
+	defer c.recoverPanic(message, send)
+
+	c.mutex.Lock()
+	catalog := c.catalog
+	c.mutex.Unlock()
+
+	if !c.identity.Allows(message.Command) {
+		c.fail(message, forbidden(c.identity, message.Command), send)
+		return
+	}
+
+	if err := validate(catalog, message.Command, message.Content); err != nil {
+		c.fail(message, err, send)
+		return
+	}
+
+	// Control commands cannot be cancelled, registering them would replace
+	// the request they may be cancelling
+	ctx := c.ctx
+
+	if !controlCommands[message.Command] {
+		var cancel context.CancelFunc
+		ctx, cancel, err = c.register(message.RequestId)
+
+		if err != nil {
+			c.fail(message, err, send)
+			return
+		}
+
+		defer c.unregister(message.RequestId, cancel)
+	}
+
+	if searchCommands[message.Command] {
+		release, err := c.acquireSearch(ctx, message.Command)
+
+		if err != nil {
+			c.fail(message, err, send)
+			return
+		}
+
+		defer release()
+	}
+
+	// Progress is only reported if the client can match it to the request
+	if message.RequestId != "" {
+		ctx = underdark.WithProgress(ctx, c.progress(message, send))
+	}
+
+	switch message.Command {
+	case "cancel":
+		response, err = c.underdarkCancel(message.Content, message.RequestId)
+	case "subscribe":
+		response, err = c.underdarkSubscribe(message.Content, message.RequestId)
+	case "unsubscribe":
+		response, err = c.underdarkUnsubscribe(message.Content, message.RequestId)
+	case "init":
+		response, err = underdarkInit(catalog, message.Content, message.RequestId)
+	case "load:variant":
+		if isChunked(message.Content) {
+			err = underdarkLoadVariantChunked(ctx, catalog, message.Content, message.RequestId, send)
+		} else if isBinary(message.Content) {
+			response, err = underdarkLoadVariantBinary(ctx, catalog, message.Content, message.RequestId)
+		} else {
+			response, err = underdarkLoadVariant(ctx, catalog, message.Content, message.RequestId)
+		}
+	case "load:stats":
+		response, err = underdarkLoadStats(catalog, message.Content, message.RequestId)
+	case "load:map":
+		if isChunked(message.Content) {
+			err = underdarkLoadMapChunked(ctx, catalog, message.Content, message.RequestId, send)
+		} else if isBinary(message.Content) {
+			response, err = underdarkLoadMapBinary(ctx, catalog, message.Content, message.RequestId)
+		} else {
+			response, err = underdarkLoadMap(ctx, catalog, message.Content, message.RequestId)
+		}
+	case "load:binpreview":
+		response, err = underdarkLoadBinPreview(catalog, message.Content, message.RequestId)
+	case "load:bin":
+		response, err = underdarkLoadBin(ctx, catalog, message.Content, message.RequestId)
+	case "search:infos":
+		response, err = underdarkSearch(ctx, catalog, message.Content, message.RequestId)
+	case "search:substructure":
+		err = underdarkSearchSubstructure(ctx, catalog, message.Content, message.RequestId, func(m SubstructureResponseMessage) error {
+			return send(m)
+		})
+	case "search:similar":
+		response, err = underdarkSearchSimilar(ctx, catalog, message.Content, message.RequestId)
+	case "load:neighbourhood":
+		response, err = underdarkLoadNeighbourhood(ctx, catalog, message.Content, message.RequestId)
+	case "locate:compounds":
+		response, err = underdarkLocateCompounds(catalog, message.Content, message.RequestId)
+	default:
+		err = underdark.NewError(underdark.ErrUnknownCommand, "unknown command %s", message.Command)
+	}
+
+	if err != nil {
+		underdark.Errorf("Error handling %s: %v", message.Command, err)
+
+		// Any other error (e.g. from reading a data file) is internal, the
+		// client still gets a response for the request
+		e, ok := err.(*underdark.Error)
+
+		if !ok {
+			e = &underdark.Error{Code: underdark.ErrInternal, Message: err.Error()}
+		}
+
+		response = errorResponse(message, e)
+	}
+
+	if response != nil {
+		send(response)
+	}
+}
+
+// Sends the error response for a request rejected before its handler runs
+func (c *Client) fail(message RequestMessage, err error, send func(interface{}) error) {
+	underdark.Errorf("Error handling %s: %v", message.Command, err)
+
+	e, ok := err.(*underdark.Error)
+
+	if !ok {
+		e = &underdark.Error{Code: underdark.ErrInternal, Message: err.Error()}
+	}
+
+	send(errorResponse(message, e))
+}
+
+// Recovers from a panic while handling the request, logs it and sends an
+// internal error response, must be deferred
+func (c *Client) recoverPanic(message RequestMessage, send func(interface{}) error) {
+	if r := recover(); r != nil {
+		underdark.Errorf("Panic handling %s: %v\n%s", message.Command, r, debug.Stack())
+		send(errorResponse(message, &underdark.Error{
+			Code:    underdark.ErrInternal,
+			Message: "internal error handling " + message.Command,
+		}))
+	}
+}
+
+// Returns a function sending progress messages for the request, at most
+// one every progressInterval unless the work is done
+func (c *Client) progress(message RequestMessage, send func(interface{}) error) underdark.ProgressFunc {
+	start := timeNow()
+	var last time.Time
+
+	return func(phase string, processed int64, total int64) {
+		now := timeNow()
+
+		if processed < total && now.Sub(last) < progressInterval {
+			return
+		}
+
+		last = now
+
+		// The estimated time remaining in seconds
+		var eta float64
+
+		if processed > 0 && total > processed {
+			eta = now.Sub(start).Seconds() * float64(total-processed) / float64(processed)
+		}
+
+		send(ProgressMessage{
+			Command:   "progress",
+			Request:   message.Command,
+			Phase:     phase,
+			Processed: processed,
+			Total:     total,
+			Eta:       eta,
+			RequestId: message.RequestId,
+		})
+	}
+}
+
+// Cancels the requests with the given request ids, unknown (e.g. already
+// finished) requests are ignored
+func (c *Client) underdarkCancel(data []string, requestId string) (CancelResponseMessage, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cancelled := make([]string, 0)
+
+	for _, requestId := range data {
+		if cancel, ok := c.cancels[requestId]; ok {
+			cancel()
+			cancelled = append(cancelled, requestId)
+		}
+	}
+
+	return CancelResponseMessage{
+		Command:   "cancel",
+		Cancelled: cancelled,
+		RequestId: requestId,
+	}, nil
+}
+
+// Subscribes the client to the given topics. Subscribers of "config" receive
+// config:changed and variant:reloaded messages when config.json has been
+// reloaded.
+func (c *Client) underdarkSubscribe(data []string, requestId string) (SubscribeResponseMessage, error) {
+	for _, topic := range data {
+		if !topics[topic] {
+			return SubscribeResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "unknown topic %s", topic)
+		}
+	}
+
+	c.server.subscribersMutex.Lock()
+	defer c.server.subscribersMutex.Unlock()
+
+	for _, topic := range data {
+		if c.server.subscribers[topic] == nil {
+			c.server.subscribers[topic] = map[*Client]bool{}
+		}
+
+		c.server.subscribers[topic][c] = true
+	}
+
+	return SubscribeResponseMessage{
+		Command:   "subscribe",
+		Topics:    c.subscriptions(),
+		RequestId: requestId,
+	}, nil
+}
+
+// Unsubscribes the client from the given topics, or from all topics if none
+// are given
+func (c *Client) underdarkUnsubscribe(data []string, requestId string) (SubscribeResponseMessage, error) {
+	c.server.subscribersMutex.Lock()
+	defer c.server.subscribersMutex.Unlock()
+
+	if len(data) == 0 {
+		for topic := range c.server.subscribers {
+			delete(c.server.subscribers[topic], c)
+		}
+	}
+
+	for _, topic := range data {
+		delete(c.server.subscribers[topic], c)
+	}
+
+	return SubscribeResponseMessage{
+		Command:   "unsubscribe",
+		Topics:    c.subscriptions(),
+		RequestId: requestId,
+	}, nil
+}
+
+// Returns the topics the client is subscribed to, the subscribersMutex of
+// the server has to be held by the caller
+func (c *Client) subscriptions() []string {
+	result := make([]string, 0)
+
+	for topic, clients := range c.server.subscribers {
+		if clients[c] {
+			result = append(result, topic)
+		}
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// Queues the notifications of a reload after those of earlier reloads
+// without blocking the caller. A single goroutine per client queues them,
+// so they are sent in the order of the reloads.
+func (c *Client) notify(messages []interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.notifications = append(c.notifications, messages...)
+
+	if !c.notifying {
+		c.notifying = true
+		go c.queueNotifications()
+	}
+}
+
+// Queues the pending notifications until there are none left, drops them
+// if the connection has been closed
+func (c *Client) queueNotifications() {
+	for {
+		c.mutex.Lock()
+		messages := c.notifications
+		c.notifications = nil
+
+		if len(messages) == 0 {
+			c.notifying = false
+			c.mutex.Unlock()
+			return
+		}
+
+		c.mutex.Unlock()
+
+		for _, v := range messages {
+			if c.queue("subscribe", v) != nil {
+				c.mutex.Lock()
+				c.notifications = nil
+				c.notifying = false
+				c.mutex.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// Creates the context of a request, requests with a request id can be
+// cancelled with the cancel command. A request id can only be used by one
+// request in progress at a time.
+func (c *Client) register(requestId string) (context.Context, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(c.ctx)
+
+	if requestId != "" {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		if _, ok := c.cancels[requestId]; ok {
+			cancel()
+			return nil, nil, underdark.NewError(underdark.ErrInvalidArgument, "request id %s is already in use", requestId)
+		}
+
+		c.cancels[requestId] = cancel
+	}
+
+	return ctx, cancel, nil
+}
+
+func (c *Client) unregister(requestId string, cancel context.CancelFunc) {
+	cancel()
+
+	if requestId != "" {
+		c.mutex.Lock()
+		delete(c.cancels, requestId)
+		c.mutex.Unlock()
+	}
+}
+
+// Passes a response (a message or the bytes of a binary message) to the
+// writer, fails if the connection has been closed in the meantime
+func (c *Client) queue(command string, v interface{}) error {
+	select {
+	case c.out <- outgoing{command, v}:
+		return nil
+	case <-c.done:
+		return errConnectionClosed
+	}
+}
+
+func errorResponse(message RequestMessage, e *underdark.Error) ErrorResponseMessage {
+	return ErrorResponseMessage{
+		Command:   "error",
+		Request:   message.Command,
+		RequestId: message.RequestId,
+		Code:      e.Code,
+		Message:   e.Message,
+	}
+}
+
+// Serialises the responses, since only one goroutine may write to the
+// connection, and pings the client
+func (c *Client) write() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.underdarkUnsubscribe(nil, "")
+		close(c.done)
+		c.stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case response := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+			messageType := websocket.BinaryMessage
+			buf, ok := response.message.([]byte)
+
+			if !ok {
+				var err error
+				messageType = websocket.TextMessage
+				buf, err = json.Marshal(response.message)
+
+				if err != nil {
+					underdark.Errorf("Error during writing: %v", err)
+					continue
+				}
+			}
+
+			// The connection is broken, closing it stops the handlers
+			if err := c.conn.WriteMessage(messageType, buf); err != nil {
+				underdark.Errorf("Error during writing: %v", err)
+				return
+			}
+
+			sentBytes.Add(float64(len(buf)), commandLabel(response.command))
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				return
+			}
+
+		case <-c.ctx.Done():
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		}
+	}
+}
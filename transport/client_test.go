@@ -0,0 +1,401 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+func TestRegister(t *testing.T) {
+	c := &Client{ctx: context.Background(), cancels: map[string]context.CancelFunc{}}
+
+	ctx, cancel, err := c.register("a")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request id in use is rejected, the request using it can still be
+	// cancelled
+	if _, _, err := c.register("a"); !hasCode(err, underdark.ErrInvalidArgument) {
+		t.Errorf("register() of a request id in use error = %v, want %s", err, underdark.ErrInvalidArgument)
+	}
+
+	if response, _ := c.underdarkCancel([]string{"a"}, ""); len(response.Cancelled) != 1 || ctx.Err() == nil {
+		t.Errorf("cancel = %v, want the request cancelled", response.Cancelled)
+	}
+
+	// The request id can be used again once the request is done
+	c.unregister("a", cancel)
+
+	if _, cancel, err := c.register("a"); err != nil {
+		t.Errorf("register() of a finished request id error = %v", err)
+	} else {
+		c.unregister("a", cancel)
+	}
+
+	// Requests without id are not registered
+	for i := 0; i < 2; i++ {
+		if _, cancel, err := c.register(""); err != nil {
+			t.Errorf("register() without request id error = %v", err)
+		} else {
+			defer cancel()
+		}
+	}
+}
+
+// The fields of a response needed to match it to its request
+type response struct {
+	Command   string `json:"cmd"`
+	RequestId string `json:"reqId"`
+	Code      string `json:"code"`
+}
+
+func TestQueueFull(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	s := NewServer(c)
+	s.RateLimit = 0
+
+	// While all request slots are held, the workers take a request each and
+	// wait, the other requests are queued until the queue is full
+	for i := 0; i < maxConcurrentRequests; i++ {
+		s.requestSlots <- struct{}{}
+	}
+
+	held := true
+	release := func() {
+		if held {
+			held = false
+			for i := 0; i < maxConcurrentRequests; i++ {
+				<-s.requestSlots
+			}
+		}
+	}
+	defer release()
+
+	conn, closeConn := dialTest(t, s)
+	defer closeConn()
+
+	responses := make(chan response)
+
+	go func() {
+		defer close(responses)
+
+		for {
+			var r response
+
+			if err := conn.ReadJSON(&r); err != nil {
+				return
+			}
+
+			responses <- r
+		}
+	}()
+
+	next := func() response {
+		select {
+		case response := <-responses:
+			return response
+		case <-time.After(5 * time.Second):
+			t.Fatal("no response")
+			return response{}
+		}
+	}
+
+	const rejected = 10
+	requests := workersPerClient + requestQueueSize + rejected
+
+	for i := 0; i < requests; i++ {
+		if err := conn.WriteJSON(RequestMessage{Command: "init", RequestId: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Depending on how fast the workers take their request, up to
+	// workersPerClient more requests are rejected
+	busy := 0
+
+	if err := conn.WriteJSON(RequestMessage{Command: "subscribe", Content: []string{"config"}, RequestId: "s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		response := next()
+
+		if response.RequestId == "s" {
+			break
+		}
+
+		if response.Command != "error" || response.Code != underdark.ErrBusy {
+			t.Fatalf("response while the queue is full = %+v, want %s", response, underdark.ErrBusy)
+		}
+
+		busy++
+	}
+
+	if busy < rejected || busy > rejected+workersPerClient {
+		t.Errorf("%d requests rejected as busy, want %d to %d", busy, rejected, rejected+workersPerClient)
+	}
+
+	// Control commands get through while the queue is full
+	if err := conn.WriteJSON(RequestMessage{Command: "cancel", Content: []string{"0"}, RequestId: "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := next(); response.RequestId != "c" || response.Command != "cancel" {
+		t.Errorf("cancel while the queue is full = %+v, want its response", response)
+	}
+
+	// Once the slots are released, the workers handle the queued requests
+	release()
+
+	for handled := 0; handled < requests-busy; handled++ {
+		if response := next(); response.Command != "init" {
+			t.Fatalf("queued request response = %+v, want init", response)
+		}
+	}
+}
+
+func TestHandleRequestId(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	client := &Client{
+		server:  NewServer(c),
+		out:     make(chan outgoing, 64),
+		done:    make(chan struct{}),
+		ctx:     ctx,
+		stop:    stop,
+		cancels: map[string]context.CancelFunc{},
+		catalog: c,
+	}
+
+	defer client.underdarkUnsubscribe(nil, "")
+
+	// Every message sent for a request echoes its id, including chunks,
+	// progress and errors
+	requests := [][]string{
+		{"init"},
+		{"load:variant", "db.fp.v"},
+		{"load:variant", "db.fp.v", "chunked"},
+		{"load:stats", "db.fp.v"},
+		{"load:map", "db.fp.v.m"},
+		{"load:map", "db.fp.v.m", "chunked"},
+		{"load:binpreview", "db", "db.fp", "db.fp.v", "0"},
+		{"load:bin", "db", "db.fp", "db.fp.v", "0"},
+		{"search:infos", "db.fp", "db.fp.v", "CCO"},
+		{"search:substructure", "db.fp", "db.fp.v", "10", "CCO"},
+		{"search:similar", "db.fp", "db.fp.v", "1;2;3", "cityblock", "1"},
+		{"load:neighbourhood", "db.fp.v", "0", "1"},
+		{"locate:compounds", "db.fp", "db.fp.v", "ids", "ID1"},
+		{"cancel", "x"},
+		{"subscribe", "config"},
+		{"unsubscribe", "config"},
+		{"load:variant", "db.fp.unknown"},
+	}
+
+	for i, request := range requests {
+		requestId := "r" + strconv.Itoa(i)
+		client.handle(RequestMessage{Command: request[0], Content: request[1:], RequestId: requestId})
+
+		if len(client.out) == 0 {
+			t.Errorf("%v sent no response", request)
+		}
+
+		for len(client.out) > 0 {
+			buf, err := json.Marshal((<-client.out).message)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var r response
+
+			if err := json.Unmarshal(buf, &r); err != nil || r.RequestId != requestId {
+				t.Errorf("%v sent %s, want request id %s", request, buf, requestId)
+			}
+		}
+	}
+}
+
+func TestReloadOrder(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	s := NewServer(c)
+
+	client := &Client{
+		server:  s,
+		out:     make(chan outgoing),
+		done:    make(chan struct{}),
+		catalog: restrict(c, nil),
+	}
+
+	if _, err := client.underdarkSubscribe([]string{"config"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.underdarkUnsubscribe(nil, "")
+
+	// The notifications of each reload are received after those of the
+	// reloads before it
+	const reloads = 20
+
+	for i := 0; i < reloads; i++ {
+		s.Reload(c, []string{"db.fp.v"})
+		s.Reload(c, nil)
+	}
+
+	want := []string{"config:changed", "variant:reloaded", "config:changed"}
+
+	for i := 0; i < reloads*len(want); i++ {
+		var command string
+
+		select {
+		case response := <-client.out:
+			switch m := response.message.(type) {
+			case ConfigChangedMessage:
+				command = m.Command
+			case VariantReloadedMessage:
+				command = m.Command
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notification")
+		}
+
+		if command != want[i%len(want)] {
+			t.Fatalf("notification %d = %s, want %s", i, command, want[i%len(want)])
+		}
+	}
+}
+
+// Opens a WebSocket connection to a test server of s, the returned function
+// closes both
+func dialTest(t *testing.T, s *Server) (*websocket.Conn, func()) {
+	server := httptest.NewServer(http.HandlerFunc(s.ServeUnderdark))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	return conn, func() {
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestControlRateLimit(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	s := NewServer(c)
+	s.RateLimit = 1
+
+	_, restore := fakeClock()
+	defer restore()
+
+	conn, closeConn := dialTest(t, s)
+	defer closeConn()
+
+	// The burst of two control commands is allowed, the rest is rejected
+	for i := 0; i < 4; i++ {
+		if err := conn.WriteJSON(RequestMessage{Command: "cancel", RequestId: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		var r response
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		if err := conn.ReadJSON(&r); err != nil {
+			t.Fatal(err)
+		}
+
+		if want := "cancel"; i >= 2 {
+			if r.Command != "error" || r.Code != underdark.ErrRateLimited {
+				t.Errorf("control command %d = %+v, want %s", i, r, underdark.ErrRateLimited)
+			}
+		} else if r.Command != want {
+			t.Errorf("control command %d = %+v, want %s", i, r, want)
+		}
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	s := NewServer(c)
+
+	conn, closeConn := dialTest(t, s)
+	defer closeConn()
+
+	// A message larger than the limit closes the connection
+	data := []string{"db", "db.fp", "db.fp.v", strings.Repeat("0,", maxMessageSize/2) + "0"}
+
+	if err := conn.WriteJSON(RequestMessage{Command: "load:bin", Content: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("reading after a message over the limit error = %v, want close %d", err, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	advance, restore := fakeClock()
+	defer restore()
+
+	var sent []ProgressMessage
+
+	c := &Client{}
+	progress := c.progress(RequestMessage{Command: "load:variant", RequestId: "r"}, func(v interface{}) error {
+		sent = append(sent, v.(ProgressMessage))
+		return nil
+	})
+
+	// Messages within progressInterval of the last one are dropped, except
+	// for the final one
+	progress("reading", 10, 100)
+	advance(progressInterval / 2)
+	progress("reading", 20, 100)
+	advance(progressInterval / 2)
+	progress("reading", 25, 100)
+	progress("reading", 50, 100)
+	progress("reading", 100, 100)
+
+	// 25 of 100 bytes took progressInterval, the other 75 take three times
+	// as long
+	eta := 3 * progressInterval.Seconds()
+
+	want := []ProgressMessage{
+		{Command: "progress", Request: "load:variant", Phase: "reading", Processed: 10, Total: 100, Eta: 0, RequestId: "r"},
+		{Command: "progress", Request: "load:variant", Phase: "reading", Processed: 25, Total: 100, Eta: eta, RequestId: "r"},
+		{Command: "progress", Request: "load:variant", Phase: "reading", Processed: 100, Total: 100, Eta: 0, RequestId: "r"},
+	}
+
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("progress messages = %+v, want %+v", sent, want)
+	}
+}
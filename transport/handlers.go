@@ -0,0 +1,697 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/search"
+	"github.com/reymond-group/underdarkgo/storage"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// The maximum number of compounds in a paginated load:bin response and,
+// unless paginated, in a load:bin request, variables so tests can lower them
+var maxBinPageSize = 10000
+var maxCompoundsPerRequest = 100000
+
+// The maximum number of bins in a load:bin request, of ids or smiles in a
+// search:infos or locate:compounds request and of queries in a
+// search:substructure request
+const maxBinsPerRequest = 10000
+const maxTermsPerRequest = 1000
+const maxQueriesPerRequest = 10
+
+// The size of the chunks sent in chunked transfer mode
+const chunkSize = 1024 * 1024
+
+func underdarkInit(catalog *catalog.Catalog, data []string, requestId string) (InitResponseMessage, error) {
+	return InitResponseMessage{
+		Command:   "init",
+		Content:   catalog.Config(),
+		RequestId: requestId,
+	}, nil
+}
+
+func underdarkLoadVariant(ctx context.Context, catalog *catalog.Catalog, data []string, requestId string) (VariantResponseMessage, error) {
+	variantId := data[0]
+	variant, err := catalog.Variant(variantId)
+
+	if err != nil {
+		return VariantResponseMessage{}, err
+	}
+
+	buf, err := storage.ReadFile(ctx, variant.CoordinatesFile)
+
+	if err != nil {
+		return VariantResponseMessage{}, err
+	}
+
+	return VariantResponseMessage{
+		Command:   "load:variant",
+		Content:   string(buf),
+		Id:        variantId,
+		RequestId: requestId,
+	}, nil
+}
+
+// Sends the coordinates in chunks, see sendChunked
+func underdarkLoadVariantChunked(ctx context.Context, catalog *catalog.Catalog, data []string, requestId string, send func(interface{}) error) error {
+	variantId := data[0]
+	variant, err := catalog.Variant(variantId)
+
+	if err != nil {
+		return err
+	}
+
+	return sendChunked(ctx, "load:variant", variantId, requestId, variant.CoordinatesFile, send)
+}
+
+// Sends the coordinates as typed arrays, see encodeBinary
+func underdarkLoadVariantBinary(ctx context.Context, catalog *catalog.Catalog, data []string, requestId string) ([]byte, error) {
+	variantId := data[0]
+	variant, err := catalog.Variant(variantId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeBinary(ctx, binaryVariant, variantId, requestId, variant.CoordinatesFile, variant.DataTypes)
+}
+
+func underdarkLoadStats(catalog *catalog.Catalog, data []string, requestId string) (StatsResponseMessage, error) {
+	variantId := data[0]
+	variantStats, err := catalog.Stats(variantId)
+
+	if err != nil {
+		return StatsResponseMessage{}, err
+	}
+
+	return StatsResponseMessage{
+		Command:   "load:stats",
+		Content:   variantStats,
+		Id:        variantId,
+		RequestId: requestId,
+	}, nil
+}
+
+func underdarkLoadMap(ctx context.Context, catalog *catalog.Catalog, data []string, requestId string) (MapResponseMessage, error) {
+	colorMapId := data[0]
+	colorMap, err := catalog.ColorMap(colorMapId)
+
+	if err != nil {
+		return MapResponseMessage{}, err
+	}
+
+	buf, err := storage.ReadFile(ctx, colorMap.MapFile)
+
+	if err != nil {
+		return MapResponseMessage{}, err
+	}
+
+	return MapResponseMessage{
+		Command:   "load:map",
+		Content:   string(buf),
+		Id:        colorMapId,
+		RequestId: requestId,
+	}, nil
+}
+
+// Sends the map in chunks, see sendChunked
+func underdarkLoadMapChunked(ctx context.Context, catalog *catalog.Catalog, data []string, requestId string, send func(interface{}) error) error {
+	colorMapId := data[0]
+	colorMap, err := catalog.ColorMap(colorMapId)
+
+	if err != nil {
+		return err
+	}
+
+	return sendChunked(ctx, "load:map", colorMapId, requestId, colorMap.MapFile, send)
+}
+
+// Sends the map as typed arrays, see encodeBinary
+func underdarkLoadMapBinary(ctx context.Context, catalog *catalog.Catalog, data []string, requestId string) ([]byte, error) {
+	colorMapId := data[0]
+	colorMap, err := catalog.ColorMap(colorMapId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeBinary(ctx, binaryMap, colorMapId, requestId, colorMap.MapFile, colorMap.DataTypes)
+}
+
+func underdarkLoadBinPreview(catalog *catalog.Catalog, data []string, requestId string) (BinPreviewResponseMessage, error) {
+	// databaseId := data[0]
+	fingerprintId := data[1]
+	variantId := data[2]
+	binIndex, err := strconv.Atoi(data[3])
+
+	if err != nil {
+		return BinPreviewResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "invalid bin index %s", data[3])
+	}
+
+	fingerprint, err := catalog.Fingerprint(fingerprintId)
+
+	if err != nil {
+		return BinPreviewResponseMessage{}, err
+	}
+
+	infoOffsets, infoLengths, err := catalog.InfoIndex(fingerprintId)
+
+	if err != nil {
+		return BinPreviewResponseMessage{}, err
+	}
+
+	bins, err := catalog.Bins(variantId)
+
+	if err != nil {
+		return BinPreviewResponseMessage{}, err
+	}
+
+	if underdark.Debug {
+		fmt.Printf("Bin preview for index %d in file %s\n", binIndex, fingerprint.InfosFile)
+	}
+
+	// Make sure that the binIndex exists and avoid out of range
+	if binIndex < 0 || len(bins) <= binIndex {
+		return BinPreviewResponseMessage{}, underdark.NewError(underdark.ErrBinOutOfRange, "binIndex %d is out of range", binIndex)
+	}
+
+	// Get the indices in the bin, an empty bin is not an error
+	compounds := bins[binIndex]
+
+	if len(compounds) < 1 {
+		return BinPreviewResponseMessage{
+			Command:   "load:binpreview",
+			Smiles:    "",
+			Index:     data[3],
+			BinSize:   "0",
+			RequestId: requestId,
+		}, nil
+	}
+
+	file, err := os.Open(fingerprint.InfosFile)
+
+	if err != nil {
+		return BinPreviewResponseMessage{}, underdark.NewError(underdark.ErrIO, "error loading bin preview: %v", err)
+	}
+
+	defer file.Close()
+
+	infoOffset := infoOffsets[compounds[0]]
+	infoLength := infoLengths[compounds[0]]
+	buf := make([]byte, int64(infoLength))
+	rn, err := file.ReadAt(buf, int64(infoOffset))
+
+	if rn < 1 {
+		return BinPreviewResponseMessage{}, underdark.NewError(underdark.ErrIO, "error loading bin preview: %v", err)
+	}
+
+	line := string(buf[:rn-1])
+	smiles := strings.Split(line, " ")
+
+	if len(smiles) < 2 {
+		return BinPreviewResponseMessage{}, underdark.NewError(underdark.ErrIO, "no smiles found at binIndex %d, line content: %s", binIndex, line)
+	}
+
+	if underdark.Debug {
+		fmt.Printf("Loading smiles from offset %d with length %d:\n%s %s\n", int64(infoOffset), int64(infoLength), smiles[0], smiles[1])
+		fmt.Printf("Returning smiles %s\n", smiles[1])
+	}
+
+	return BinPreviewResponseMessage{
+		Command:   "load:binpreview",
+		Smiles:    smiles[1],
+		Index:     data[3],
+		BinSize:   strconv.Itoa(len(compounds)),
+		RequestId: requestId,
+	}, nil
+}
+
+func underdarkLoadBin(ctx context.Context, catalog *catalog.Catalog, data []string, requestId string) (BinResponseMessage, error) {
+	// databaseId := data[0]
+	fingerprintId := data[1]
+	variantId := data[2]
+	binIndices, err := parseBinIndices(data[3])
+
+	if err != nil {
+		return BinResponseMessage{}, err
+	}
+
+	if len(binIndices) > maxBinsPerRequest {
+		return BinResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "at most %d bins can be loaded at once", maxBinsPerRequest)
+	}
+
+	fingerprint, err := catalog.Fingerprint(fingerprintId)
+
+	if err != nil {
+		return BinResponseMessage{}, err
+	}
+
+	infoOffsets, infoLengths, err := catalog.InfoIndex(fingerprintId)
+
+	if err != nil {
+		return BinResponseMessage{}, err
+	}
+
+	bins, err := catalog.Bins(variantId)
+
+	if err != nil {
+		return BinResponseMessage{}, err
+	}
+
+	// Check whether the binIndices are within range and count the compounds
+	// before collecting any of them
+	total := 0
+
+	for i := 0; i < len(binIndices); i++ {
+		if uint32(len(bins)) <= binIndices[i] {
+			return BinResponseMessage{}, underdark.NewError(underdark.ErrBinOutOfRange, "binIndex %d is out of range", binIndices[i])
+		}
+
+		total += len(bins[binIndices[i]])
+	}
+
+	// If an offset (or the continuation token of a previous response) or a
+	// limit is given, only return that page of compounds, the limit defaults
+	// to maxBinPageSize
+	offset := 0
+	end := total
+	next := ""
+
+	if optionalArgument(data, 4) != "" || optionalArgument(data, 5) != "" {
+		limit := maxBinPageSize
+
+		if value := optionalArgument(data, 4); value != "" {
+			offset, err = strconv.Atoi(value)
+
+			if err != nil || offset < 0 {
+				return BinResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "invalid offset %s", value)
+			}
+		}
+
+		if value := optionalArgument(data, 5); value != "" {
+			limit, err = strconv.Atoi(value)
+
+			if err != nil || limit < 1 {
+				return BinResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "invalid limit %s", value)
+			}
+		}
+
+		if offset > total {
+			offset = total
+		}
+
+		if limit > maxBinPageSize {
+			limit = maxBinPageSize
+		}
+
+		if offset+limit < total {
+			end = offset + limit
+			next = strconv.Itoa(end)
+		}
+	} else if total > maxCompoundsPerRequest {
+		return BinResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument,
+			"the bins contain %d compounds, at most %d can be loaded at once, use offset and limit", total, maxCompoundsPerRequest)
+	}
+
+	// Only the compounds of the page are collected
+	compounds, compoundBinIndices := binPage(bins, binIndices, offset, end)
+
+	infoFile, err := os.Open(fingerprint.InfosFile)
+
+	if err != nil {
+		return BinResponseMessage{}, underdark.NewError(underdark.ErrIO, "error loading bin: %v", err)
+	}
+
+	defer infoFile.Close()
+
+	length := len(compounds)
+	ids := make([]string, length)
+	smiles := make([]string, length)
+	fps := make([]string, length)
+	coords := make([]string, length)
+
+	for i := 0; i < length; i++ {
+		if i%underdark.CancelCheckInterval == 0 && ctx.Err() != nil {
+			return BinResponseMessage{}, underdark.Cancelled(ctx)
+		}
+
+		infoOffset := infoOffsets[compounds[i]]
+		infoLength := infoLengths[compounds[i]]
+
+		buf := make([]byte, int64(infoLength))
+		rn, err := infoFile.ReadAt(buf, int64(infoOffset))
+
+		if rn < 1 {
+			return BinResponseMessage{}, underdark.NewError(underdark.ErrIO, "error loading bin: %v", err)
+		}
+
+		info := string(buf[:rn-1])
+		infos := strings.Split(info, " ")
+
+		if len(infos) < 3 {
+			return BinResponseMessage{}, underdark.NewError(underdark.ErrIO, "failed to load infos from file %s, line loaded: %s",
+				fingerprint.InfosFile, info)
+		}
+
+		ids[i] = infos[0]
+		smiles[i] = infos[1]
+		fps[i] = infos[2]
+		coords[i] = infos[2]
+	}
+
+	return BinResponseMessage{
+		Command:    "load:bin",
+		Smiles:     smiles,
+		Ids:        ids,
+		Coords:     coords,
+		Fps:        fps,
+		BinIndices: compoundBinIndices,
+		Index:      data[3],
+		BinSize:    strconv.Itoa(total),
+		Total:      total,
+		Offset:     offset,
+		Next:       next,
+		RequestId:  requestId,
+	}, nil
+}
+
+func underdarkSearch(ctx context.Context, catalog *catalog.Catalog, data []string, requestId string) (SearchResponseMessage, error) {
+	// The first two strings are the fingerprint and variant ids,
+	// from there on, the strings are search queries
+	fingerprintId := data[0]
+	variantId := data[1]
+	searchTerms := data[2:len(data)]
+
+	filteredSearchTerms := filterSearchTerms(searchTerms)
+
+	if len(filteredSearchTerms) > maxTermsPerRequest {
+		return SearchResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "at most %d search terms can be searched at once", maxTermsPerRequest)
+	}
+
+	result, err := search.Infos(ctx, catalog, fingerprintId, variantId, filteredSearchTerms)
+
+	if err != nil {
+		return SearchResponseMessage{}, err
+	}
+
+	return SearchResponseMessage{
+		Command:     "search:infos",
+		BinIndices:  result,
+		SearchTerms: filteredSearchTerms,
+		RequestId:   requestId,
+	}, nil
+}
+
+func underdarkSearchSubstructure(ctx context.Context, catalog *catalog.Catalog, data []string, requestId string, send func(SubstructureResponseMessage) error) error {
+	// The first three strings are the fingerprint and variant ids and the
+	// maximum number of hits (empty for the default), from there on, the
+	// strings are SMILES or SMARTS queries
+	fingerprintId := data[0]
+	variantId := data[1]
+	limit := 0
+
+	if data[2] != "" {
+		var err error
+		limit, err = strconv.Atoi(data[2])
+
+		if err != nil {
+			return underdark.NewError(underdark.ErrInvalidArgument, "invalid maximum number of hits %s", data[2])
+		}
+	}
+
+	searchTerms := filterSearchTerms(data[3:len(data)])
+
+	if len(searchTerms) > maxQueriesPerRequest {
+		return underdark.NewError(underdark.ErrInvalidArgument, "at most %d queries can be searched at once", maxQueriesPerRequest)
+	}
+
+	if limit <= 0 {
+		limit = search.DefaultSubstructureHits
+	} else if limit > search.MaxSubstructureHits {
+		limit = search.MaxSubstructureHits
+	}
+
+	// Partial results are sent as they are found, the last response has
+	// done set to true
+	sendPartial := func(binIndices [][]uint32, processed uint32, truncated bool, done bool) error {
+		return send(SubstructureResponseMessage{
+			Command:     "search:substructure",
+			BinIndices:  binIndices,
+			SearchTerms: searchTerms,
+			Processed:   processed,
+			Truncated:   truncated,
+			Done:        done,
+			RequestId:   requestId,
+		})
+	}
+
+	return search.Substructure(ctx, catalog, fingerprintId, variantId, searchTerms, limit, sendPartial)
+}
+
+func underdarkSearchSimilar(ctx context.Context, catalog *catalog.Catalog, data []string, requestId string) (SimilarResponseMessage, error) {
+	// The strings are the fingerprint and variant ids, the query fingerprint,
+	// the metric (cityblock, euclidean or tanimoto), the number of nearest
+	// neighbours k (empty for the default) and an optional distance threshold
+	fingerprintId := data[0]
+	variantId := data[1]
+	query := data[2]
+	metric := data[3]
+	k := 0
+
+	if data[4] != "" {
+		var err error
+		k, err = strconv.Atoi(data[4])
+
+		if err != nil {
+			return SimilarResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "invalid number of neighbours %s", data[4])
+		}
+	}
+
+	threshold := math.Inf(1)
+
+	if len(data) > 5 && data[5] != "" {
+		t, err := strconv.ParseFloat(data[5], 64)
+
+		if err != nil {
+			return SimilarResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "invalid distance threshold %s", data[5])
+		}
+
+		threshold = t
+	}
+
+	// With a threshold and without k, all compounds within the threshold
+	// are returned (up to the maximum), the response is truncated if there
+	// are more than the maximum
+	capped := false
+
+	if k <= 0 && !math.IsInf(threshold, 1) || k > search.MaxSimilarHits {
+		k = search.MaxSimilarHits
+		capped = true
+	} else if k <= 0 {
+		k = search.DefaultSimilarHits
+	}
+
+	hits, truncated, err := search.Similar(ctx, catalog, fingerprintId, variantId, query, metric, k, threshold)
+
+	if err != nil {
+		return SimilarResponseMessage{}, err
+	}
+
+	n := len(hits)
+	ids := make([]string, n)
+	smiles := make([]string, n)
+	distances := make([]float64, n)
+	binIndices := make([]uint32, n)
+
+	for i, hit := range hits {
+		ids[i] = hit.Id
+		smiles[i] = hit.Smiles
+		distances[i] = hit.Distance
+		binIndices[i] = hit.Bin
+	}
+
+	return SimilarResponseMessage{
+		Command:    "search:similar",
+		Ids:        ids,
+		Smiles:     smiles,
+		Distances:  distances,
+		BinIndices: binIndices,
+		Metric:     metric,
+		Truncated:  capped && truncated,
+		RequestId:  requestId,
+	}, nil
+}
+
+func underdarkLoadNeighbourhood(ctx context.Context, catalog *catalog.Catalog, data []string, requestId string) (NeighbourhoodResponseMessage, error) {
+	// The strings are the variant id, the bin index, the radius in grid
+	// cells and the shape of the neighbourhood (sphere or cube)
+	variantId := data[0]
+	binIndex, err := strconv.Atoi(data[1])
+
+	if err != nil {
+		return NeighbourhoodResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "invalid bin index %s", data[1])
+	}
+
+	radius, err := strconv.Atoi(data[2])
+
+	if err != nil {
+		return NeighbourhoodResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "invalid radius %s", data[2])
+	}
+
+	cube := len(data) > 3 && data[3] == "cube"
+
+	binIndices, binSizes, err := search.Neighbourhood(ctx, catalog, variantId, binIndex, radius, cube)
+
+	if err != nil {
+		return NeighbourhoodResponseMessage{}, err
+	}
+
+	return NeighbourhoodResponseMessage{
+		Command:    "load:neighbourhood",
+		BinIndices: binIndices,
+		BinSizes:   binSizes,
+		Index:      data[1],
+		Id:         variantId,
+		RequestId:  requestId,
+	}, nil
+}
+
+func underdarkLocateCompounds(catalog *catalog.Catalog, data []string, requestId string) (LocateResponseMessage, error) {
+	// The first three strings are the fingerprint and variant ids and
+	// whether the compounds are given as "ids" or as "lines" (line
+	// numbers in the infos file), the rest are the compounds. Each
+	// compound gets the bins of its lines, unknown ids none and lines
+	// that are not in any bin -1, see search.Locate.
+	fingerprintId := data[0]
+	variantId := data[1]
+	byId := data[2] == "ids"
+	compounds := filterSearchTerms(data[3:len(data)])
+
+	if len(compounds) > maxTermsPerRequest {
+		return LocateResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "at most %d compounds can be located at once", maxTermsPerRequest)
+	}
+
+	// The line numbers of the compounds given by id
+	var lines [][]uint32
+
+	if byId {
+		searchIndex, err := catalog.SearchIndex(fingerprintId)
+
+		if err != nil {
+			return LocateResponseMessage{}, err
+		}
+
+		lines, err = searchIndex.Lookup(compounds)
+
+		if err != nil {
+			return LocateResponseMessage{}, err
+		}
+	}
+
+	bins, err := catalog.CompoundBins(variantId)
+
+	if err != nil {
+		return LocateResponseMessage{}, err
+	}
+
+	coordinates, err := catalog.Coordinates(variantId)
+
+	if err != nil {
+		return LocateResponseMessage{}, err
+	}
+
+	n := len(compounds)
+	binIndices := make([][]int64, n)
+	coords := make([][]string, n)
+
+	for i := 0; i < n; i++ {
+		var compoundLines []uint32
+
+		if byId {
+			compoundLines = lines[i]
+		} else {
+			line, err := strconv.ParseUint(compounds[i], 10, 32)
+
+			if err != nil {
+				return LocateResponseMessage{}, underdark.NewError(underdark.ErrInvalidArgument, "invalid line number %s", compounds[i])
+			}
+
+			compoundLines = []uint32{uint32(line)}
+		}
+
+		binIndices[i], coords[i] = search.Locate(bins, coordinates, compoundLines)
+	}
+
+	return LocateResponseMessage{
+		Command:    "locate:compounds",
+		BinIndices: binIndices,
+		Coords:     coords,
+		Compounds:  compounds,
+		Id:         variantId,
+		RequestId:  requestId,
+	}, nil
+}
+
+// Returns the argument at index i, an empty string if it is not given
+// Returns the compounds from offset to end (exclusive) of the given bins,
+// counted over the bins in the given order, and the bin of each compound
+func binPage(bins [][]uint32, binIndices []uint32, offset int, end int) ([]uint32, []uint32) {
+	compounds := make([]uint32, 0, end-offset)
+	compoundBinIndices := make([]uint32, 0, end-offset)
+
+	// The number of compounds in the bins before bin i
+	skipped := 0
+
+	for i := 0; i < len(binIndices) && skipped < end; i++ {
+		compoundsInBin := bins[binIndices[i]]
+		from, to := offset-skipped, end-skipped
+		skipped += len(compoundsInBin)
+
+		if from < 0 {
+			from = 0
+		}
+
+		if to > len(compoundsInBin) {
+			to = len(compoundsInBin)
+		}
+
+		if from >= to {
+			continue
+		}
+
+		compounds = append(compounds, compoundsInBin[from:to]...)
+
+		for j := from; j < to; j++ {
+			compoundBinIndices = append(compoundBinIndices, binIndices[i])
+		}
+	}
+
+	return compounds, compoundBinIndices
+}
+
+func optionalArgument(data []string, i int) string {
+	if i < len(data) {
+		return data[i]
+	}
+
+	return ""
+}
+
+func filterSearchTerms(terms []string) []string {
+	filtered := make([]string, 0)
+
+	for _, v := range terms {
+		if v != "" {
+			filtered = append(filtered, v)
+		}
+	}
+
+	return filtered
+}
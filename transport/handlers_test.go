@@ -0,0 +1,267 @@
+package transport
+
+import (
+	"context"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/reymond-group/underdarkgo/search"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+func TestSimilarTruncated(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	// The query is at a cityblock distance of 0 and 9 from the two compounds
+	tests := []struct {
+		k         int
+		threshold float64
+		hits      int
+		truncated bool
+	}{
+		{1, math.Inf(1), 1, true},
+		{2, math.Inf(1), 2, false},
+		{1, 5, 1, false},
+		{1, 9, 1, true},
+	}
+
+	for _, test := range tests {
+		hits, truncated, err := search.Similar(context.Background(), c, "db.fp", "db.fp.v", "1;2;3", "cityblock", test.k, test.threshold)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(hits) != test.hits || truncated != test.truncated {
+			t.Errorf("Similar(k %d, threshold %v) = %d hits, truncated %v, want %d, %v",
+				test.k, test.threshold, len(hits), truncated, test.hits, test.truncated)
+		}
+	}
+
+	// The response is only truncated if the hits were capped at the maximum
+	response, err := underdarkSearchSimilar(context.Background(), c, []string{"db.fp", "db.fp.v", "1;2;3", "cityblock", "1"}, "")
+
+	if err != nil || response.Truncated || len(response.Ids) != 1 {
+		t.Errorf("underdarkSearchSimilar(k 1) = %+v, %v, want one hit, not truncated", response, err)
+	}
+
+	// An empty k is the default, as accepted by validate
+	response, err = underdarkSearchSimilar(context.Background(), c, []string{"db.fp", "db.fp.v", "1;2;3", "cityblock", ""}, "")
+
+	if err != nil || response.Truncated || len(response.Ids) != 2 {
+		t.Errorf("underdarkSearchSimilar(k empty) = %+v, %v, want two hits, not truncated", response, err)
+	}
+
+	// The handlers check the numbers even without validate
+	if _, err := underdarkSearchSimilar(context.Background(), c, []string{"db.fp", "db.fp.v", "1;2;3", "cityblock", "a"}, ""); !hasCode(err, underdark.ErrInvalidArgument) {
+		t.Errorf("underdarkSearchSimilar(k a) error = %v, want %s", err, underdark.ErrInvalidArgument)
+	}
+
+	if _, _, err := search.Similar(context.Background(), c, "db.fp", "db.fp.v", "1;2;3", "cityblock", 0, 5); !hasCode(err, underdark.ErrInvalidArgument) {
+		t.Errorf("Similar(k 0) error = %v, want %s", err, underdark.ErrInvalidArgument)
+	}
+
+	send := func(SubstructureResponseMessage) error { return nil }
+
+	if err := underdarkSearchSubstructure(context.Background(), c, []string{"db.fp", "db.fp.v", "a", "CCO"}, "", send); !hasCode(err, underdark.ErrInvalidArgument) {
+		t.Errorf("underdarkSearchSubstructure(limit a) error = %v, want %s", err, underdark.ErrInvalidArgument)
+	}
+
+	if err := underdarkSearchSubstructure(context.Background(), c, []string{"db.fp", "db.fp.v", "", "CCO"}, "", send); err != nil {
+		t.Errorf("underdarkSearchSubstructure(limit empty) error = %v, want nil", err)
+	}
+}
+
+func TestSubstructureTruncated(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	// Both queries match CCO only, the hits of all queries count
+	tests := []struct {
+		queries   []string
+		limit     int
+		hits      int
+		truncated bool
+	}{
+		{[]string{"CCO"}, 1, 1, false},
+		{[]string{"C", "CO"}, 1, 1, true},
+		{[]string{"C", "CO"}, 2, 2, false},
+	}
+
+	for _, test := range tests {
+		hits := 0
+		truncated := false
+
+		err := search.Substructure(context.Background(), c, "db.fp", "db.fp.v", test.queries, test.limit,
+			func(binIndices [][]uint32, processed uint32, t bool, done bool) error {
+				for _, bins := range binIndices {
+					hits += len(bins)
+				}
+
+				truncated = t
+
+				return nil
+			})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hits != test.hits || truncated != test.truncated {
+			t.Errorf("Substructure(%v, limit %d) = %d hits, truncated %v, want %d, %v",
+				test.queries, test.limit, hits, truncated, test.hits, test.truncated)
+		}
+	}
+}
+
+func TestLoadBinPages(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	defer func(pageSize, maxCompounds int) {
+		maxBinPageSize = pageSize
+		maxCompoundsPerRequest = maxCompounds
+	}(maxBinPageSize, maxCompoundsPerRequest)
+
+	// Bin 0 holds ID1 and bin 1 ID2
+	tests := []struct {
+		bins     string
+		page     []string // offset and limit
+		pageSize int
+		ids      []string
+		bin      []uint32
+		offset   int
+		next     string
+	}{
+		{"0,1", nil, 10, []string{"ID1", "ID2"}, []uint32{0, 1}, 0, ""},
+		{"0,1", []string{"", ""}, 10, []string{"ID1", "ID2"}, []uint32{0, 1}, 0, ""},
+		{"0,1", []string{"", "1"}, 10, []string{"ID1"}, []uint32{0}, 0, "1"},
+		{"0,1", []string{"1", ""}, 10, []string{"ID2"}, []uint32{1}, 1, ""},
+		{"0,1", []string{"1", "1"}, 10, []string{"ID2"}, []uint32{1}, 1, ""},
+		{"1,0", []string{"1", "5"}, 10, []string{"ID1"}, []uint32{0}, 1, ""},
+		{"1,0", []string{"0", "1"}, 10, []string{"ID2"}, []uint32{1}, 0, "1"},
+		{"0,1", []string{"2", ""}, 10, []string{}, []uint32{}, 2, ""},
+		{"0,1", []string{"5", "1"}, 10, []string{}, []uint32{}, 2, ""},
+		{"0,1", []string{"0", "50"}, 1, []string{"ID1"}, []uint32{0}, 0, "1"},
+		{"0,1", []string{"0"}, 1, []string{"ID1"}, []uint32{0}, 0, "1"},
+	}
+
+	for _, test := range tests {
+		maxBinPageSize = test.pageSize
+		data := append([]string{"db", "db.fp", "db.fp.v", test.bins}, test.page...)
+		response, err := underdarkLoadBin(context.Background(), c, data, "")
+
+		if err != nil {
+			t.Errorf("underdarkLoadBin(%q) error = %v", data, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(response.Ids, test.ids) || !reflect.DeepEqual(response.BinIndices, test.bin) ||
+			response.Total != 2 || response.Offset != test.offset || response.Next != test.next {
+			t.Errorf("underdarkLoadBin(%q) = ids %v, bins %v, total %d, offset %d, next %q, want %v, %v, 2, %d, %q",
+				data, response.Ids, response.BinIndices, response.Total, response.Offset, response.Next,
+				test.ids, test.bin, test.offset, test.next)
+		}
+	}
+
+	// Without offset and limit, the number of compounds is capped
+	maxBinPageSize = 10
+	maxCompoundsPerRequest = 1
+
+	if _, err := underdarkLoadBin(context.Background(), c, []string{"db", "db.fp", "db.fp.v", "0,1"}, ""); !hasCode(err, underdark.ErrInvalidArgument) {
+		t.Errorf("underdarkLoadBin() of too many compounds error = %v, want %s", err, underdark.ErrInvalidArgument)
+	}
+
+	if response, err := underdarkLoadBin(context.Background(), c, []string{"db", "db.fp", "db.fp.v", "0,1", "", "2"}, ""); err != nil || len(response.Ids) != 2 {
+		t.Errorf("underdarkLoadBin() of a page = %v, %v, want 2 compounds", response.Ids, err)
+	}
+
+	for _, page := range [][]string{{"x", ""}, {"-1", ""}, {"", "0"}, {"", "a"}} {
+		data := append([]string{"db", "db.fp", "db.fp.v", "0,1"}, page...)
+
+		if _, err := underdarkLoadBin(context.Background(), c, data, ""); !hasCode(err, underdark.ErrInvalidArgument) {
+			t.Errorf("underdarkLoadBin(%q) error = %v, want %s", data, err, underdark.ErrInvalidArgument)
+		}
+	}
+}
+
+func TestEmptyBin(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	// The second line of private/fp/v/v.dat is empty, so bin 1 is empty and
+	// ID3 (line 0) is in bin 0 only
+	if bins, err := c.CompoundBins("private.fp.v"); err != nil || !reflect.DeepEqual(bins, []uint32{0}) {
+		t.Errorf("CompoundBins() = %v, %v, want [0]", bins, err)
+	}
+
+	response, err := underdarkSearch(context.Background(), c, []string{"private.fp", "private.fp.v", "ID3"}, "")
+
+	if err != nil || !reflect.DeepEqual(response.BinIndices, [][]uint32{{0}}) {
+		t.Errorf("search ID3 = %v, %v, want [[0]]", response.BinIndices, err)
+	}
+
+	preview, err := underdarkLoadBinPreview(c, []string{"private", "private.fp", "private.fp.v", "1"}, "")
+
+	if err != nil || preview.Smiles != "" || preview.BinSize != "0" {
+		t.Errorf("preview of the empty bin = %+v, %v, want no smiles", preview, err)
+	}
+
+	if stats, err := c.Stats("private.fp.v"); err != nil || stats.CompoundCount != 1 || stats.HistMin != 0 {
+		t.Errorf("Stats() = %+v, %v, want 1 compound and an empty bin", stats, err)
+	}
+}
+
+func TestNeighbourhoodEmptyBin(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	// Bin 1 of the private variant at 3,3,3 is empty and skipped
+	response, err := underdarkLoadNeighbourhood(context.Background(), c, []string{"private.fp.v", "0", "5"}, "")
+
+	if err != nil || !reflect.DeepEqual(response.BinIndices, []uint32{0}) || !reflect.DeepEqual(response.BinSizes, []uint32{1}) {
+		t.Errorf("neighbourhood = bins %v, sizes %v, %v, want [0], [1]", response.BinIndices, response.BinSizes, err)
+	}
+}
+
+func TestLocateNotInBin(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	// Line 1 is not in any bin of the private variant
+	response, err := underdarkLocateCompounds(c, []string{"private.fp", "private.fp.v", "lines", "0", "1"}, "")
+
+	if err != nil || !reflect.DeepEqual(response.BinIndices, [][]int64{{0}, {-1}}) {
+		t.Errorf("locate lines 0 and 1 = %v, %v, want [[0] [-1]]", response.BinIndices, err)
+	}
+}
+
+func TestBinPage(t *testing.T) {
+	bins := [][]uint32{{0, 1, 2}, {}, {3, 4}, {5}}
+
+	tests := []struct {
+		binIndices []uint32
+		offset     int
+		end        int
+		compounds  []uint32
+		bin        []uint32
+	}{
+		{[]uint32{0, 1, 2, 3}, 0, 6, []uint32{0, 1, 2, 3, 4, 5}, []uint32{0, 0, 0, 2, 2, 3}},
+		{[]uint32{0, 1, 2, 3}, 1, 4, []uint32{1, 2, 3}, []uint32{0, 0, 2}},
+		{[]uint32{0, 1, 2, 3}, 3, 4, []uint32{3}, []uint32{2}},
+		{[]uint32{3, 2, 0}, 2, 5, []uint32{4, 0, 1}, []uint32{2, 0, 0}},
+		{[]uint32{1, 2}, 2, 2, []uint32{}, []uint32{}},
+	}
+
+	for _, test := range tests {
+		compounds, bin := binPage(bins, test.binIndices, test.offset, test.end)
+
+		if !reflect.DeepEqual(compounds, test.compounds) || !reflect.DeepEqual(bin, test.bin) {
+			t.Errorf("binPage(%v, %d, %d) = %v, %v, want %v, %v", test.binIndices, test.offset, test.end,
+				compounds, bin, test.compounds, test.bin)
+		}
+	}
+}
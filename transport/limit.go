@@ -0,0 +1,231 @@
+package transport
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// The number of searches handled at the same time over all connections and
+// per connection
+const maxConcurrentSearches = 8
+const maxSearchesPerClient = 2
+
+// How long an idle limiter is kept before it is removed
+const limiterIdleTime = 10 * time.Minute
+
+// The clock of the rate limiters and progress messages, replaced in tests
+var timeNow = time.Now
+
+var searchCommands = map[string]bool{
+	"search:infos":        true,
+	"search:substructure": true,
+	"search:similar":      true,
+	"load:neighbourhood":  true,
+}
+
+// A token bucket allowing rate requests per second and bursts of twice
+// the rate
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// Returns a limiter allowing rate requests per second, nil (allowing all
+// requests) if rate is 0
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{rate: rate, tokens: burst(rate), last: timeNow()}
+}
+
+func burst(rate float64) float64 {
+	return math.Max(2*rate, 1)
+}
+
+// Takes a token from the bucket, if it is empty returns false and the time
+// until a token is available
+func (l *rateLimiter) take() (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := timeNow()
+	l.tokens = math.Min(l.tokens+now.Sub(l.last).Seconds()*l.rate, burst(l.rate))
+	l.last = now
+
+	if l.tokens < 1 {
+		return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+
+	l.tokens--
+
+	return true, 0
+}
+
+func (l *rateLimiter) idle(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return now.Sub(l.last) > limiterIdleTime
+}
+
+// The rate limiters by key, idle limiters are removed
+type limiters struct {
+	mutex    sync.Mutex
+	limiters map[string]*rateLimiter
+	pruned   time.Time
+}
+
+func newLimiters() *limiters {
+	return &limiters{limiters: map[string]*rateLimiter{}, pruned: timeNow()}
+}
+
+// Returns the limiter of the key, creates it allowing rate requests per
+// second if there is none
+func (l *limiters) get(key string, rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := timeNow()
+
+	if now.Sub(l.pruned) > limiterIdleTime {
+		for k, limiter := range l.limiters {
+			if limiter.idle(now) {
+				delete(l.limiters, k)
+			}
+		}
+
+		l.pruned = now
+	}
+
+	limiter, ok := l.limiters[key]
+
+	if !ok {
+		limiter = newRateLimiter(rate)
+		l.limiters[key] = limiter
+	}
+
+	return limiter
+}
+
+// Takes a token from each limiter, if any of them is empty returns false
+// and the time until a token is available
+func takeAll(limiters ...*rateLimiter) (bool, time.Duration) {
+	for _, limiter := range limiters {
+		if ok, wait := limiter.take(); !ok {
+			return false, wait
+		}
+	}
+
+	return true, 0
+}
+
+// Returns the error sent to the client if the rate limit is exceeded
+func rateLimited(wait time.Duration) *underdark.Error {
+	return &underdark.Error{
+		Code:    underdark.ErrRateLimited,
+		Message: "rate limit exceeded, retry in " + strconv.FormatFloat(wait.Seconds(), 'f', 1, 64) + "s",
+	}
+}
+
+// Returns the limiter of the token of the identity, nil if authentication
+// is disabled
+func (s *Server) tokenLimiter(identity *Identity) *rateLimiter {
+	if identity == nil {
+		return nil
+	}
+
+	return s.tokenLimiters.get(identity.Name, s.TokenRateLimit)
+}
+
+// Rate limits an API request by its token or, without token, by its remote
+// address, writes an error response if the limit is exceeded and returns
+// whether the request may proceed
+func (s *Server) apiRateLimit(w http.ResponseWriter, r *http.Request, identity *Identity) bool {
+	limiter := s.tokenLimiter(identity)
+
+	if identity == nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		limiter = s.addressLimiters.get(host, s.RateLimit)
+	}
+
+	if ok, wait := takeAll(limiter); !ok {
+		e := rateLimited(wait)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		apiError(w, http.StatusTooManyRequests, e.Code, e.Message)
+		return false
+	}
+
+	return true
+}
+
+// Waits for one of the maxConcurrentSearches search slots, returns a
+// function releasing it and recording the duration of the search
+func (s *Server) acquireSearch(ctx context.Context, command string) (func(), error) {
+	select {
+	case s.searchSlots <- struct{}{}:
+		start := time.Now()
+
+		return func() {
+			searchDuration.Observe(time.Since(start).Seconds(), command)
+			<-s.searchSlots
+		}, nil
+	case <-ctx.Done():
+		return nil, underdark.Cancelled(ctx)
+	}
+}
+
+// Like acquireSearch, but fails with a rate limited error if the client is
+// already running maxSearchesPerClient searches
+func (c *Client) acquireSearch(ctx context.Context, command string) (func(), error) {
+	c.mutex.Lock()
+
+	if c.searches >= maxSearchesPerClient {
+		c.mutex.Unlock()
+		return nil, underdark.NewError(underdark.ErrRateLimited, "at most %d searches can run at the same time per connection", maxSearchesPerClient)
+	}
+
+	c.searches++
+	c.mutex.Unlock()
+
+	decrement := func() {
+		c.mutex.Lock()
+		c.searches--
+		c.mutex.Unlock()
+	}
+
+	release, err := c.server.acquireSearch(ctx, command)
+
+	if err != nil {
+		decrement()
+		return nil, err
+	}
+
+	return func() {
+		release()
+		decrement()
+	}, nil
+}
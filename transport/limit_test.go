@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+// Replaces the clock of the rate limiters and progress messages, returns a
+// function advancing it and a function restoring it
+func fakeClock() (func(time.Duration), func()) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	return func(d time.Duration) { now = now.Add(d) }, func() { timeNow = time.Now }
+}
+
+// Takes tokens until the limiter is empty, returns the number taken
+func drain(limiters ...*rateLimiter) int {
+	n := 0
+
+	for ; n < 1000; n++ {
+		if ok, _ := takeAll(limiters...); !ok {
+			break
+		}
+	}
+
+	return n
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	_, restore := fakeClock()
+	defer restore()
+
+	tests := []struct {
+		rate float64
+		want int
+	}{
+		{10, 20},
+		{1, 2},
+		{0.2, 1},
+	}
+
+	for _, test := range tests {
+		if got := drain(newRateLimiter(test.rate)); got != test.want {
+			t.Errorf("rate %v allows a burst of %d, want %d", test.rate, got, test.want)
+		}
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	advance, restore := fakeClock()
+	defer restore()
+
+	limiter := newRateLimiter(10)
+	drain(limiter)
+
+	ok, wait := limiter.take()
+
+	if ok || wait != 100*time.Millisecond {
+		t.Errorf("take() on an empty limiter = %v, %v, want false, %v", ok, wait, 100*time.Millisecond)
+	}
+
+	advance(500 * time.Millisecond)
+
+	if got := drain(limiter); got != 5 {
+		t.Errorf("%d tokens after 500ms, want 5", got)
+	}
+
+	// The bucket does not fill beyond the burst
+	advance(time.Hour)
+
+	if got := drain(limiter); got != 20 {
+		t.Errorf("%d tokens after an hour, want 20", got)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	if limiter := newRateLimiter(0); limiter != nil {
+		t.Errorf("newRateLimiter(0) = %+v, want nil", limiter)
+	}
+
+	if got := drain(nil); got != 1000 {
+		t.Errorf("nil limiter allows %d requests, want all", got)
+	}
+}
+
+func TestRateLimiterPerToken(t *testing.T) {
+	advance, restore := fakeClock()
+	defer restore()
+
+	tokens := newLimiters()
+
+	// Two connections of the same token, each allowed 10 requests per
+	// second, share the token limit of 5 requests per second
+	first := newRateLimiter(10)
+	second := newRateLimiter(10)
+
+	if got := drain(first, tokens.get("lab", 5)); got != 10 {
+		t.Errorf("first connection allowed %d requests, want 10", got)
+	}
+
+	if got := drain(second, tokens.get("lab", 5)); got != 0 {
+		t.Errorf("second connection allowed %d requests, want 0", got)
+	}
+
+	// Other tokens have their own limit
+	if got := drain(newRateLimiter(10), tokens.get("admin", 5)); got != 10 {
+		t.Errorf("connection of another token allowed %d requests, want 10", got)
+	}
+
+	// The token limit refills at its own rate
+	advance(time.Second)
+
+	if got := drain(first, tokens.get("lab", 5)); got != 5 {
+		t.Errorf("first connection allowed %d requests after a second, want 5", got)
+	}
+
+	// The connection limit applies even if the token limit is higher
+	if got := drain(newRateLimiter(10), tokens.get("other", 50)); got != 20 {
+		t.Errorf("connection allowed %d requests, want 20", got)
+	}
+
+	// Idle limiters are removed and start with a full bucket
+	advance(2 * limiterIdleTime)
+
+	if got := drain(tokens.get("lab", 5)); got != 10 {
+		t.Errorf("idle token allowed %d requests, want 10", got)
+	}
+}
@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"github.com/reymond-group/underdarkgo/catalog"
+)
+
+type RequestMessage struct {
+	Command   string   `json:"cmd"`
+	Content   []string `json:"msg"`
+	RequestId string   `json:"reqId"`
+}
+
+type InitResponseMessage struct {
+	Command   string                `json:"cmd"`
+	Content   catalog.Configuration `json:"msg"`
+	RequestId string                `json:"reqId"`
+}
+
+type VariantResponseMessage struct {
+	Command   string `json:"cmd"`
+	Content   string `json:"msg"`
+	Id        string `json:"id"`
+	RequestId string `json:"reqId"`
+}
+
+type ChunkHeaderMessage struct {
+	Command   string `json:"cmd"`
+	Id        string `json:"id"`
+	Size      int64  `json:"size"`
+	Chunks    int64  `json:"chunks"`
+	ChunkSize int    `json:"chunkSize"`
+	Checksum  string `json:"checksum"`
+	RequestId string `json:"reqId"`
+}
+
+type ChunkMessage struct {
+	Command   string `json:"cmd"`
+	Id        string `json:"id"`
+	Index     int64  `json:"index"`
+	Content   string `json:"msg"`
+	RequestId string `json:"reqId"`
+}
+
+type StatsResponseMessage struct {
+	Command   string        `json:"cmd"`
+	Content   catalog.Stats `json:"msg"`
+	Id        string        `json:"id"`
+	RequestId string        `json:"reqId"`
+}
+
+type MapResponseMessage struct {
+	Command   string `json:"cmd"`
+	Content   string `json:"msg"`
+	Id        string `json:"id"`
+	RequestId string `json:"reqId"`
+}
+
+type BinPreviewResponseMessage struct {
+	Command   string `json:"cmd"`
+	Smiles    string `json:"smiles"`
+	Index     string `json:"index"`
+	BinSize   string `json:"binSize"`
+	RequestId string `json:"reqId"`
+}
+
+type BinResponseMessage struct {
+	Command    string   `json:"cmd"`
+	Smiles     []string `json:"smiles"`
+	Ids        []string `json:"ids"`
+	Coords     []string `json:"coordinates"`
+	Fps        []string `json:"fps"`
+	BinIndices []uint32 `json:"binIndices"`
+	Index      string   `json:"index"`
+	BinSize    string   `json:"binSize"`
+	Total      int      `json:"total"`
+	Offset     int      `json:"offset"`
+	Next       string   `json:"next"`
+	RequestId  string   `json:"reqId"`
+}
+
+type SearchResponseMessage struct {
+	Command     string     `json:"cmd"`
+	BinIndices  [][]uint32 `json:"binIndices"`
+	SearchTerms []string   `json:"searchTerms"`
+	RequestId   string     `json:"reqId"`
+}
+
+type SubstructureResponseMessage struct {
+	Command     string     `json:"cmd"`
+	BinIndices  [][]uint32 `json:"binIndices"`
+	SearchTerms []string   `json:"searchTerms"`
+	Processed   uint32     `json:"processed"`
+	Truncated   bool       `json:"truncated"`
+	Done        bool       `json:"done"`
+	RequestId   string     `json:"reqId"`
+}
+
+type SimilarResponseMessage struct {
+	Command    string    `json:"cmd"`
+	Ids        []string  `json:"ids"`
+	Smiles     []string  `json:"smiles"`
+	Distances  []float64 `json:"distances"`
+	BinIndices []uint32  `json:"binIndices"`
+	Metric     string    `json:"metric"`
+	Truncated  bool      `json:"truncated"`
+	RequestId  string    `json:"reqId"`
+}
+
+type NeighbourhoodResponseMessage struct {
+	Command    string   `json:"cmd"`
+	BinIndices []uint32 `json:"binIndices"`
+	BinSizes   []uint32 `json:"binSizes"`
+	Index      string   `json:"index"`
+	Id         string   `json:"id"`
+	RequestId  string   `json:"reqId"`
+}
+
+type LocateResponseMessage struct {
+	Command    string     `json:"cmd"`
+	BinIndices [][]int64  `json:"binIndices"`
+	Coords     [][]string `json:"coordinates"`
+	Compounds  []string   `json:"compounds"`
+	Id         string     `json:"id"`
+	RequestId  string     `json:"reqId"`
+}
+
+type ProgressMessage struct {
+	Command   string  `json:"cmd"`
+	Request   string  `json:"request"`
+	Phase     string  `json:"phase"`
+	Processed int64   `json:"processed"`
+	Total     int64   `json:"total"`
+	Eta       float64 `json:"eta"`
+	RequestId string  `json:"reqId"`
+}
+
+type CancelResponseMessage struct {
+	Command   string   `json:"cmd"`
+	Cancelled []string `json:"cancelled"`
+	RequestId string   `json:"reqId"`
+}
+
+type SubscribeResponseMessage struct {
+	Command   string   `json:"cmd"`
+	Topics    []string `json:"topics"`
+	RequestId string   `json:"reqId"`
+}
+
+type ConfigChangedMessage struct {
+	Command string                `json:"cmd"`
+	Content catalog.Configuration `json:"msg"`
+}
+
+type VariantReloadedMessage struct {
+	Command string `json:"cmd"`
+	Id      string `json:"id"`
+}
+
+type ErrorResponseMessage struct {
+	Command   string `json:"cmd"`
+	Request   string `json:"request"`
+	RequestId string `json:"reqId"`
+	Code      string `json:"code"`
+	Message   string `json:"msg"`
+}
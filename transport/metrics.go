@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/metrics"
+)
+
+var requestsTotal = metrics.NewCounter("underdark_requests_total",
+	"The number of WebSocket requests handled by command and error code (ok if successful).", "command", "code")
+
+var requestDuration = metrics.NewHistogram("underdark_request_duration_seconds",
+	"The time spent handling WebSocket requests by command.", metrics.DefaultBuckets, "command")
+
+var sentBytes = metrics.NewCounter("underdark_sent_bytes_total",
+	"The bytes sent over WebSocket connections by command.", "command")
+
+var searchDuration = metrics.NewHistogram("underdark_search_duration_seconds",
+	"The time spent searching (without waiting for a search slot) by command.", metrics.DefaultBuckets, "command")
+
+var activeConnections int64
+
+var _ = metrics.NewGaugeFunc("underdark_connections_active",
+	"The number of open WebSocket connections.", func() map[string]float64 {
+		return map[string]float64{"": float64(atomic.LoadInt64(&activeConnections))}
+	})
+
+// The metrics are process-wide, they report the catalog last set on any
+// server (the program runs one)
+var metricsCatalog *catalog.Catalog
+var metricsCatalogMutex sync.RWMutex
+
+func setMetricsCatalog(c *catalog.Catalog) {
+	metricsCatalogMutex.Lock()
+	metricsCatalog = c
+	metricsCatalogMutex.Unlock()
+}
+
+// Only the variants of public databases are listed, the metrics are not
+// authenticated
+var _ = metrics.NewGaugeFunc("underdark_variant_indices_bytes",
+	"The approximate memory used by the bin contents of each variant of the public databases.", func() map[string]float64 {
+		values := map[string]float64{}
+
+		metricsCatalogMutex.RLock()
+		c := metricsCatalog
+		metricsCatalogMutex.RUnlock()
+
+		if c != nil {
+			c = c.Restrict(nil)
+
+			for variantId, size := range c.IndicesSize() {
+				values[variantId] = float64(size)
+			}
+		}
+
+		return values
+	}, "variant")
+
+// Returns the command as metric label, unknown commands are combined so
+// clients cannot create arbitrary many series
+func commandLabel(command string) string {
+	if _, ok := commands[command]; ok {
+		return command
+	}
+
+	return "unknown"
+}
+
+func observeRequest(command string, code string, start time.Time) {
+	requestsTotal.Inc(commandLabel(command), code)
+	requestDuration.Observe(time.Since(start).Seconds(), commandLabel(command))
+}
@@ -0,0 +1,144 @@
+package transport
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/reymond-group/underdarkgo/catalog"
+)
+
+// The default requests per second allowed per connection and per token
+const DefaultRateLimit = 20
+const DefaultTokenRateLimit = 50
+
+// Serves a catalog over WebSocket (ServeUnderdark) and as a REST API
+// (ServeApi). The exported fields have to be set before serving.
+type Server struct {
+	// The authenticators tokens are checked against, a token is accepted if
+	// any of them accepts it. Authentication is disabled if empty.
+	Authenticators []Authenticator
+
+	// The origins (e.g. "https://example.org") allowed to open WebSocket
+	// connections, all origins are allowed if empty
+	AllowedOrigins []string
+
+	// The requests per second allowed per connection (or, for API requests
+	// without token, per remote address) and per token, unlimited if 0.
+	// Bursts of twice the rate are allowed.
+	RateLimit      float64
+	TokenRateLimit float64
+
+	// The catalog new connections and API requests are served from
+	catalog      *catalog.Catalog
+	catalogMutex sync.RWMutex
+
+	// The clients subscribed to each topic, see Reload
+	subscribers      map[string]map[*Client]bool
+	subscribersMutex sync.Mutex
+
+	// Holds a slot for each request being handled (see Client.work) and for
+	// each search (see acquireSearch)
+	requestSlots chan struct{}
+	searchSlots  chan struct{}
+
+	// The limiters of the tokens (by name) and of the remote addresses of
+	// API requests without token
+	tokenLimiters   *limiters
+	addressLimiters *limiters
+
+	upgrader websocket.Upgrader
+}
+
+// Returns a server serving the catalog with the default rate limits and
+// without authentication
+func NewServer(catalog *catalog.Catalog) *Server {
+	s := &Server{
+		RateLimit:       DefaultRateLimit,
+		TokenRateLimit:  DefaultTokenRateLimit,
+		subscribers:     map[string]map[*Client]bool{},
+		requestSlots:    make(chan struct{}, maxConcurrentRequests),
+		searchSlots:     make(chan struct{}, maxConcurrentSearches),
+		tokenLimiters:   newLimiters(),
+		addressLimiters: newLimiters(),
+	}
+
+	s.upgrader = websocket.Upgrader{
+		EnableCompression: true,
+		CheckOrigin:       s.checkOrigin,
+	}
+
+	s.SetCatalog(catalog)
+
+	return s
+}
+
+// Requests without Origin header are not sent by a browser and are allowed
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if len(s.AllowedOrigins) == 0 || origin == "" {
+		return true
+	}
+
+	for _, allowed := range s.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) currentCatalog() *catalog.Catalog {
+	s.catalogMutex.RLock()
+	defer s.catalogMutex.RUnlock()
+
+	return s.catalog
+}
+
+// Sets the catalog new connections and API requests are served from
+func (s *Server) SetCatalog(catalog *catalog.Catalog) {
+	s.catalogMutex.Lock()
+	s.catalog = catalog
+	s.catalogMutex.Unlock()
+
+	setMetricsCatalog(catalog)
+}
+
+// Replaces the catalog after config.json has been reloaded and notifies the
+// subscribers of "config", variants lists the ids of the variants whose data
+// has changed. The subscribers are served from the new catalog from now on,
+// all other connections keep the catalog they started with. Each subscriber
+// is only notified about the databases it may access.
+func (s *Server) Reload(catalog *catalog.Catalog, variants []string) {
+	s.SetCatalog(catalog)
+
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
+
+	for c := range s.subscribers["config"] {
+		view := restrict(catalog, c.identity)
+
+		c.mutex.Lock()
+		c.catalog = view
+		c.mutex.Unlock()
+
+		messages := []interface{}{ConfigChangedMessage{
+			Command: "config:changed",
+			Content: view.Config(),
+		}}
+
+		for _, variantId := range variants {
+			if _, err := view.Variant(variantId); err == nil {
+				messages = append(messages, VariantReloadedMessage{
+					Command: "variant:reloaded",
+					Id:      variantId,
+				})
+			}
+		}
+
+		c.notify(messages)
+	}
+}
@@ -0,0 +1,147 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// How often the certificate and key files are checked for modifications
+const certificatePollInterval = 30 * time.Second
+
+// A TLS certificate that is reloaded from disk when the certificate or key
+// file is renewed
+type Certificate struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+// Loads the certificate and key, see Watch to reload them on renewal
+func LoadCertificate(certFile string, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Returns the current certificate, used as tls.Config.GetCertificate
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.certificate, nil
+}
+
+// Returns a TLS configuration serving the current certificate, HTTP/2 is
+// negotiated by the server
+func (c *Certificate) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+// Reloads the certificate when the certificate or key file has been modified
+// or the process receives SIGHUP. If the new files are invalid (e.g. while
+// only one of them has been replaced), the error is logged and the current
+// certificate is kept.
+func (c *Certificate) Watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(certificatePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			c.reload()
+		case <-ticker.C:
+			if c.modified() {
+				c.reload()
+			}
+		}
+	}
+}
+
+// Returns whether the certificate or key file has been modified since the
+// certificate was loaded
+func (c *Certificate) modified() bool {
+	return !c.lastModified().Equal(c.modTime)
+}
+
+// Loads the certificate again, keeps the current certificate if the files
+// are invalid
+func (c *Certificate) reload() {
+	underdark.Infof("Reloading %s ...", c.certFile)
+
+	if err := c.load(); err != nil {
+		underdark.Errorf("Error during reloading, keeping the current certificate: %v", err)
+	}
+}
+
+func (c *Certificate) load() error {
+	modTime := c.lastModified()
+
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.certificate = &certificate
+	c.mutex.Unlock()
+
+	// Only accessed by load, modified and Watch, which run sequentially
+	c.modTime = modTime
+
+	return nil
+}
+
+// Returns the latest modification time of the certificate and key file
+func (c *Certificate) lastModified() time.Time {
+	var modTime time.Time
+
+	for _, file := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime
+}
+
+// Returns a handler redirecting requests to the same URL on HTTPS, listen is
+// the address the HTTPS server listens on
+func RedirectHandler(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,171 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		listen string
+		host   string
+		target string
+		want   string
+	}{
+		{":443", "example.org", "/", "https://example.org/"},
+		{":443", "example.org:80", "/underdark?token=a%20b", "https://example.org/underdark?token=a%20b"},
+		{"0.0.0.0:8443", "example.org", "/api/v1/init", "https://example.org:8443/api/v1/init"},
+		{":8443", "example.org:8080", "/api/v1/fingerprints/db.fp/variants/db.fp.v/search?q=CCO&q=C",
+			"https://example.org:8443/api/v1/fingerprints/db.fp/variants/db.fp.v/search?q=CCO&q=C"},
+		{"[::]:8443", "[::1]:80", "/", "https://[::1]:8443/"},
+		{"[::]:443", "[::1]", "/", "https://[::1]/"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://"+test.host+test.target, nil)
+		w := httptest.NewRecorder()
+		RedirectHandler(test.listen).ServeHTTP(w, r)
+
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != test.want {
+			t.Errorf("redirect of %s%s (listening on %s) = %d %s, want 301 %s", test.host, test.target, test.listen,
+				w.Code, w.Header().Get("Location"), test.want)
+		}
+	}
+}
+
+// Writes a self-signed certificate for the name and its key, modified at
+// modTime, if key is nil a new key is generated. Returns the key.
+func writeCertificate(t *testing.T, certFile string, keyFile string, name string, key *ecdsa.PrivateKey, modTime time.Time) *ecdsa.PrivateKey {
+	var err error
+
+	if key == nil {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return key
+}
+
+// Returns the common name of the certificate served
+func servedName(t *testing.T, c *Certificate) string {
+	certificate, err := c.GetCertificate(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "underdark")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now()
+	writeCertificate(t, certFile, keyFile, "a", nil, start)
+
+	c, err := LoadCertificate(certFile, keyFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.modified() {
+		t.Error("modified() after loading = true, want false")
+	}
+
+	// A valid renewal is picked up
+	key := writeCertificate(t, certFile, keyFile, "b", nil, start.Add(time.Minute))
+
+	if !c.modified() {
+		t.Error("modified() after renewing = false, want true")
+	}
+
+	c.reload()
+
+	if name := servedName(t, c); name != "b" || c.modified() {
+		t.Errorf("certificate after renewing = %s (modified %v), want b", name, c.modified())
+	}
+
+	// While only the certificate has been replaced, the pair is invalid and
+	// the current certificate is kept
+	otherKeyFile := filepath.Join(dir, "other.pem")
+	writeCertificate(t, certFile, otherKeyFile, "c", nil, start.Add(2*time.Minute))
+
+	if !c.modified() {
+		t.Error("modified() after replacing the certificate = false, want true")
+	}
+
+	c.reload()
+
+	if name := servedName(t, c); name != "b" {
+		t.Errorf("certificate after an invalid renewal = %s, want b", name)
+	}
+
+	// Once the key matches again, the certificate is reloaded
+	writeCertificate(t, certFile, keyFile, "d", key, start.Add(3*time.Minute))
+	c.reload()
+
+	if name := servedName(t, c); name != "d" {
+		t.Errorf("certificate after completing the renewal = %s, want d", name)
+	}
+}
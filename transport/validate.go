@@ -0,0 +1,207 @@
+package transport
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/search"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// The kinds of the arguments of the commands, see validate
+type argumentKind int
+
+const (
+	argString argumentKind = iota
+	argDatabase
+	argFingerprint
+	argVariant
+	argMap
+	argBin    // a bin index
+	argBins   // comma separated bin indices
+	argInt    // an integer, empty for the default
+	argOffset // a non-negative integer, empty for the default
+	argLimit  // a positive integer, empty for the default
+	argFloat  // a number, empty for the default
+	argMode   // the transfer mode, empty, chunked or binary
+	argShape  // the shape of a neighbourhood, empty, sphere or cube
+	argRadius // the radius of a neighbourhood, 0 to search.MaxNeighbourhoodRadius
+	argBy     // how compounds are given, ids or lines
+)
+
+var argumentNames = map[argumentKind]string{
+	argString:      "string",
+	argDatabase:    "database id",
+	argFingerprint: "fingerprint id",
+	argVariant:     "variant id",
+	argMap:         "map id",
+	argBin:         "bin index",
+	argBins:        "bin indices",
+	argInt:         "integer",
+	argOffset:      "offset",
+	argLimit:       "limit",
+	argFloat:       "number",
+	argMode:        "transfer mode",
+	argShape:       "shape",
+	argRadius:      "radius",
+	argBy:          "ids or lines",
+}
+
+// The arguments of a command, the required arguments are followed by the
+// optional arguments and, if variadic, any number of strings
+type commandArguments struct {
+	required []argumentKind
+	optional []argumentKind
+	variadic bool
+}
+
+var commands = map[string]commandArguments{
+	"cancel":              {variadic: true},
+	"subscribe":           {variadic: true},
+	"unsubscribe":         {variadic: true},
+	"init":                {variadic: true},
+	"load:variant":        {required: []argumentKind{argVariant}, optional: []argumentKind{argMode}},
+	"load:stats":          {required: []argumentKind{argVariant}},
+	"load:map":            {required: []argumentKind{argMap}, optional: []argumentKind{argMode}},
+	"load:binpreview":     {required: []argumentKind{argDatabase, argFingerprint, argVariant, argBin}},
+	"load:bin":            {required: []argumentKind{argDatabase, argFingerprint, argVariant, argBins}, optional: []argumentKind{argOffset, argLimit}},
+	"search:infos":        {required: []argumentKind{argFingerprint, argVariant}, variadic: true},
+	"search:substructure": {required: []argumentKind{argFingerprint, argVariant, argInt}, variadic: true},
+	"search:similar":      {required: []argumentKind{argFingerprint, argVariant, argString, argString, argInt}, optional: []argumentKind{argFloat}},
+	"load:neighbourhood":  {required: []argumentKind{argVariant, argBin, argRadius}, optional: []argumentKind{argShape}},
+	"locate:compounds":    {required: []argumentKind{argFingerprint, argVariant, argBy}, variadic: true},
+}
+
+// Checks the number and types of the arguments of a command and that the
+// ids exist in the catalog and belong together (e.g. the variant to the
+// fingerprint), so the handlers can rely on them
+func validate(catalog *catalog.Catalog, command string, data []string) error {
+	arguments, ok := commands[command]
+
+	if !ok {
+		return underdark.NewError(underdark.ErrUnknownCommand, "unknown command %s", command)
+	}
+
+	nRequired := len(arguments.required)
+	nOptional := len(arguments.optional)
+
+	if len(data) < nRequired {
+		return underdark.NewError(underdark.ErrInvalidArgument, "%s requires at least %d arguments, got %d", command, nRequired, len(data))
+	}
+
+	if !arguments.variadic && len(data) > nRequired+nOptional {
+		return underdark.NewError(underdark.ErrInvalidArgument, "%s accepts at most %d arguments, got %d", command, nRequired+nOptional, len(data))
+	}
+
+	kinds := append(append([]argumentKind{}, arguments.required...), arguments.optional...)
+
+	for i, kind := range kinds {
+		if i >= len(data) {
+			break
+		}
+
+		if err := validateArgument(catalog, kind, data[i]); err != nil {
+			if e, ok := err.(*underdark.Error); ok && e.Code != underdark.ErrInvalidArgument {
+				return err
+			}
+
+			return underdark.NewError(underdark.ErrInvalidArgument, "argument %d of %s is not a valid %s: %s",
+				i+1, command, argumentNames[kind], data[i])
+		}
+
+		// The ids of a database, a fingerprint, a variant and a map follow
+		// each other in this order
+		if i > 0 && isId(kinds[i-1]) && kind == kinds[i-1]+1 && !catalog.Contains(data[i-1], data[i]) {
+			return underdark.NewError(underdark.ErrInvalidArgument, "%s %s does not belong to %s %s",
+				argumentNames[kind], data[i], argumentNames[kinds[i-1]], data[i-1])
+		}
+	}
+
+	return nil
+}
+
+func isId(kind argumentKind) bool {
+	return kind == argDatabase || kind == argFingerprint || kind == argVariant
+}
+
+// Returns an error if the value is not of the kind, for ids the error of the
+// catalog lookup
+func validateArgument(catalog *catalog.Catalog, kind argumentKind, value string) error {
+	var err error
+
+	switch kind {
+	case argDatabase:
+		_, err = catalog.Database(value)
+	case argFingerprint:
+		_, err = catalog.Fingerprint(value)
+	case argVariant:
+		_, err = catalog.Variant(value)
+	case argMap:
+		_, err = catalog.ColorMap(value)
+	case argBin:
+		_, err = strconv.ParseUint(value, 10, 32)
+	case argBins:
+		_, err = parseBinIndices(value)
+	case argInt:
+		if value != "" {
+			_, err = strconv.Atoi(value)
+		}
+	case argOffset, argLimit:
+		if value != "" {
+			var n int
+			n, err = strconv.Atoi(value)
+
+			if err == nil && (n < 0 || n == 0 && kind == argLimit) {
+				err = underdark.NewError(underdark.ErrInvalidArgument, "%s out of range", argumentNames[kind])
+			}
+		}
+	case argFloat:
+		if value != "" {
+			_, err = strconv.ParseFloat(value, 64)
+		}
+	case argMode:
+		err = oneOf(value, "", "chunked", "binary")
+	case argShape:
+		err = oneOf(value, "", "sphere", "cube")
+	case argRadius:
+		var radius int
+		radius, err = strconv.Atoi(value)
+
+		if err == nil && (radius < 0 || radius > search.MaxNeighbourhoodRadius) {
+			err = underdark.NewError(underdark.ErrInvalidArgument, "the radius has to be between 0 and %d", search.MaxNeighbourhoodRadius)
+		}
+	case argBy:
+		err = oneOf(value, "ids", "lines")
+	}
+
+	return err
+}
+
+func oneOf(value string, values ...string) error {
+	for _, v := range values {
+		if value == v {
+			return nil
+		}
+	}
+
+	return underdark.NewError(underdark.ErrInvalidArgument, "expected one of %s", strings.Join(values, ", "))
+}
+
+// Parses comma separated bin indices
+func parseBinIndices(s string) ([]uint32, error) {
+	values := strings.Split(s, ",")
+	result := make([]uint32, len(values))
+
+	for i, v := range values {
+		index, err := strconv.ParseUint(v, 10, 32)
+
+		if err != nil {
+			return nil, underdark.NewError(underdark.ErrInvalidArgument, "invalid bin index %s", v)
+		}
+
+		result[i] = uint32(index)
+	}
+
+	return result, nil
+}
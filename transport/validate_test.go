@@ -0,0 +1,151 @@
+package transport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/reymond-group/underdarkgo/catalog"
+	"github.com/reymond-group/underdarkgo/underdark"
+)
+
+// Writes a data directory with the public database db and the database
+// private, restricted to the token name admin and the role internal, and
+// loads it. Each database has a fingerprint fp with a variant v of two bins
+// and a map m, e.g. db.fp.v.m. The directory has to be removed by the
+// caller.
+func testCatalog(t *testing.T) (*catalog.Catalog, string) {
+	dir, err := ioutil.TempDir("", "underdark")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database := `{"id": "%s", "directory": "%s", %s"fingerprints": [{
+		"id": "fp", "directory": "fp", "infosFile": "i.info", "infoIndicesFile": "i.index",
+		"variants": [{"id": "v", "directory": "v", "resolution": 250,
+			"dataTypes": ["uint16", "uint16", "uint16"], "indicesFile": "v.dat", "coordinatesFile": "v.xyz",
+			"maps": [{"id": "m", "mapFile": "v.map", "dataTypes": ["float32", "float32", "float32"]}]}]}]}`
+
+	files := map[string]string{
+		"config.json": `{"databases": [` + fmt.Sprintf(database, "db", "db", "") + ", " +
+			fmt.Sprintf(database, "private", "private", `"access": ["admin", "internal"], `) + `]}`,
+		"db/fp/i.info":       "ID1 CCO 1;2;3\nID2 c1ccccc1 4;5;6\n",
+		"db/fp/i.index":      "0,14\n14,20\n",
+		"db/fp/v/v.dat":      "0\n1\n",
+		"db/fp/v/v.xyz":      "1,1,1\n2,2,2\n",
+		"db/fp/v/v.map":      "0,0.5,1\n1,0.5,0\n",
+		"private/fp/i.info":  "ID3 CCN 7;8;9\n",
+		"private/fp/i.index": "0,14\n",
+		"private/fp/v/v.dat": "0\n\n",
+		"private/fp/v/v.xyz": "1,1,1\n3,3,3\n",
+		"private/fp/v/v.map": "0,0.5,1\n1,0.5,0\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config, err := catalog.LoadConfig(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _, err := catalog.New(dir, config, nil)
+
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return c, dir
+}
+
+func TestValidate(t *testing.T) {
+	c, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		command string
+		data    []string
+		want    string // the error code, empty if valid
+	}{
+		{"init", nil, ""},
+		{"init", []string{"ignored"}, ""},
+		{"cancel", []string{"a", "b"}, ""},
+		{"subscribe", []string{}, ""},
+		{"unknown", nil, underdark.ErrUnknownCommand},
+
+		// Arity
+		{"load:variant", nil, underdark.ErrInvalidArgument},
+		{"load:variant", []string{"db.fp.v"}, ""},
+		{"load:variant", []string{"db.fp.v", "binary"}, ""},
+		{"load:variant", []string{"db.fp.v", "binary", "extra"}, underdark.ErrInvalidArgument},
+		{"load:stats", []string{"db.fp.v", ""}, underdark.ErrInvalidArgument},
+		{"search:infos", []string{"db.fp", "db.fp.v", "CCO", "ID2"}, ""},
+		{"search:infos", []string{"db.fp"}, underdark.ErrInvalidArgument},
+
+		// Ids
+		{"load:bin", []string{"db", "db.fp", "db.fp.v", "0,1"}, ""},
+		{"load:bin", []string{"other", "db.fp", "db.fp.v", "0"}, underdark.ErrUnknownDatabase},
+		{"load:bin", []string{"db", "db.other", "db.fp.v", "0"}, underdark.ErrUnknownFingerprint},
+		{"load:bin", []string{"db", "db.fp", "db.fp.other", "0"}, underdark.ErrUnknownVariant},
+		{"load:map", []string{"db.fp.v.m"}, ""},
+		{"load:map", []string{"db.fp.v.other"}, underdark.ErrUnknownMap},
+
+		// Ids of different databases
+		{"load:bin", []string{"private", "db.fp", "db.fp.v", "0"}, underdark.ErrInvalidArgument},
+		{"load:bin", []string{"db", "db.fp", "private.fp.v", "0"}, underdark.ErrInvalidArgument},
+		{"load:bin", []string{"private", "private.fp", "private.fp.v", "0"}, ""},
+		{"search:infos", []string{"private.fp", "db.fp.v", "CCO"}, underdark.ErrInvalidArgument},
+		{"search:similar", []string{"db.fp", "private.fp.v", "1;2;3", "cosine", "10"}, underdark.ErrInvalidArgument},
+		{"search:substructure", []string{"db.fp", "private.fp.v", "1", "CC"}, underdark.ErrInvalidArgument},
+		{"locate:compounds", []string{"private.fp", "db.fp.v", "ids", "ID1"}, underdark.ErrInvalidArgument},
+
+		// Kinds
+		{"load:variant", []string{"db.fp.v", "zipped"}, underdark.ErrInvalidArgument},
+		{"load:binpreview", []string{"db", "db.fp", "db.fp.v", "1"}, ""},
+		{"load:binpreview", []string{"db", "db.fp", "db.fp.v", "-1"}, underdark.ErrInvalidArgument},
+		{"load:bin", []string{"db", "db.fp", "db.fp.v", "0,a"}, underdark.ErrInvalidArgument},
+		{"load:bin", []string{"db", "db.fp", "db.fp.v", "0", "", "10"}, ""},
+		{"load:bin", []string{"db", "db.fp", "db.fp.v", "0", "-1"}, underdark.ErrInvalidArgument},
+		{"load:bin", []string{"db", "db.fp", "db.fp.v", "0", "0", "0"}, underdark.ErrInvalidArgument},
+		{"search:substructure", []string{"db.fp", "db.fp.v", "x", "CC"}, underdark.ErrInvalidArgument},
+		{"search:substructure", []string{"db.fp", "db.fp.v", "", "CC"}, ""},
+		{"search:similar", []string{"db.fp", "db.fp.v", "1;2;3", "cosine", ""}, ""},
+		{"search:similar", []string{"db.fp", "db.fp.v", "1;2;3", "cosine", "10"}, ""},
+		{"search:similar", []string{"db.fp", "db.fp.v", "1;2;3", "cosine", "", "0.5"}, ""},
+		{"search:similar", []string{"db.fp", "db.fp.v", "1;2;3", "cosine", "10", "high"}, underdark.ErrInvalidArgument},
+		{"load:neighbourhood", []string{"db.fp.v", "0", "2", "cube"}, ""},
+		{"load:neighbourhood", []string{"db.fp.v", "0", "2", "ball"}, underdark.ErrInvalidArgument},
+		{"load:neighbourhood", []string{"db.fp.v", "0", "100"}, ""},
+		{"load:neighbourhood", []string{"db.fp.v", "0", "101"}, underdark.ErrInvalidArgument},
+		{"load:neighbourhood", []string{"db.fp.v", "0", "-1"}, underdark.ErrInvalidArgument},
+		{"load:neighbourhood", []string{"db.fp.v", "0", "1000"}, underdark.ErrInvalidArgument},
+		{"locate:compounds", []string{"db.fp", "db.fp.v", "lines", "0"}, ""},
+		{"locate:compounds", []string{"db.fp", "db.fp.v", "names", "ID1"}, underdark.ErrInvalidArgument},
+	}
+
+	for _, test := range tests {
+		err := validate(c, test.command, test.data)
+		code := ""
+
+		if e, ok := err.(*underdark.Error); ok {
+			code = e.Code
+		} else if err != nil {
+			code = err.Error()
+		}
+
+		if code != test.want {
+			t.Errorf("validate(%s, %q) = %v, want %q", test.command, test.data, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package underdark
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// The log levels, messages below the current level are discarded
+const (
+	LogDebug = iota
+	LogInfo
+	LogError
+)
+
+var logLevel = LogInfo
+
+var logLevels = map[string]int{
+	"debug": LogDebug,
+	"info":  LogInfo,
+	"error": LogError,
+}
+
+// Returns the log level with the given name (debug, info or error)
+func ParseLogLevel(name string) (int, error) {
+	level, ok := logLevels[strings.ToLower(name)]
+
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %s", name)
+	}
+
+	return level, nil
+}
+
+// Sets the log level, the debug level also enables Debug
+func SetLogLevel(level int) {
+	logLevel = level
+	Debug = level == LogDebug
+}
+
+func Infof(format string, a ...interface{}) {
+	if logLevel <= LogInfo {
+		log.Printf(format, a...)
+	}
+}
+
+func Errorf(format string, a ...interface{}) {
+	if logLevel <= LogError {
+		log.Printf(format, a...)
+	}
+}
@@ -0,0 +1,68 @@
+// Package underdark contains the error codes, cancellation and progress
+// reporting shared by the other packages.
+package underdark
+
+import (
+	"context"
+	"fmt"
+)
+
+// The machine-readable codes of the errors returned to the client
+const (
+	ErrUnknownCommand     = "unknown_command"
+	ErrUnknownDatabase    = "unknown_database"
+	ErrUnknownFingerprint = "unknown_fingerprint"
+	ErrUnknownVariant     = "unknown_variant"
+	ErrUnknownMap         = "unknown_map"
+	ErrBinOutOfRange      = "bin_out_of_range"
+	ErrInvalidArgument    = "invalid_argument"
+	ErrIO                 = "io_error"
+	ErrCancelled          = "cancelled"
+	ErrBusy               = "busy"
+	ErrUnauthorized       = "unauthorized"
+	ErrForbidden          = "forbidden"
+	ErrRateLimited        = "rate_limited"
+	ErrInternal           = "internal_error"
+)
+
+// An error returned by a handler, sent to the client as an error response
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func NewError(code string, format string, a ...interface{}) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Returns the error for a request stopped because ctx was cancelled
+func Cancelled(ctx context.Context) error {
+	return NewError(ErrCancelled, "request cancelled: %v", ctx.Err())
+}
+
+// The number of lines read between checks for cancellation
+const CancelCheckInterval = 1000
+
+// Reports the progress of a phase (e.g. the number of lines searched) of a
+// request, the progress function is stored in the request context
+type ProgressFunc func(phase string, processed int64, total int64)
+
+type progressKey struct{}
+
+// Returns a context reporting the progress of the request to progress
+func WithProgress(ctx context.Context, progress ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+func ReportProgress(ctx context.Context, phase string, processed int64, total int64) {
+	if progress, ok := ctx.Value(progressKey{}).(ProgressFunc); ok {
+		progress(phase, processed, total)
+	}
+}
+
+// Enables additional logging, set by the DEBUG environment variable
+var Debug bool